@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/go-gst/go-gst/gst"
+	"k8s.io/klog"
+)
+
+// Range of the gain of an audio input, limited by the volume element
+const (
+	audioGainMinDB = -60.0
+	audioGainMaxDB = 20.0
+)
+
+var errUnsupportedAudioSetting = errors.New("unsupported audio setting")
+
+// audioInputUpdate changes the settings of an audio input at runtime. nil
+// fields are left unchanged.
+type audioInputUpdate struct {
+	mute          *bool
+	gainDB        *float64
+	amplification *float64
+}
+
+func (u *audioInputUpdate) validate() error {
+	if u.gainDB != nil && (*u.gainDB < audioGainMinDB || *u.gainDB > audioGainMaxDB) {
+		return fmt.Errorf("gain must be between %g and %g dB", audioGainMinDB, audioGainMaxDB)
+	}
+	if u.amplification != nil && *u.amplification < 0 {
+		return fmt.Errorf("amplification must not be negative")
+	}
+	return nil
+}
+
+// Returns the volume element in the strip and the audioamplify element in the
+// source bin of an audio input. amplify is nil if the source has none.
+func (p *pipeline) audioInputElements(name string) (volume *gst.Element, amplify *gst.Element, err error) {
+	in := p.audioInput(name)
+	if in == nil {
+		return nil, nil, errUnknownSource
+	}
+	if in.strip == nil {
+		return nil, nil, fmt.Errorf("%w: channels of audio input '%s' are mapped to other inputs", errUnsupportedAudioSetting, name)
+	}
+	volume, err = in.strip.GetElementByName("volume_" + in.strip.GetName())
+	if err != nil {
+		return nil, nil, err
+	}
+	// Only the ALSA source bin amplifies
+	amplify, _ = in.src.GetElementByName("audioamplify_" + in.src.GetName())
+	return volume, amplify, nil
+}
+
+// Returns the current settings of an audio input
+func (p *pipeline) audioInputState(name string) (audioInputState, error) {
+	volume, amplify, err := p.audioInputElements(name)
+	if err != nil {
+		return audioInputState{}, err
+	}
+
+	a := audioInputState{Amplification: 1}
+	v, err := volume.GetProperty("volume")
+	if err != nil {
+		return a, err
+	}
+	a.GainDB = max(20*math.Log10(v.(float64)), audioGainMinDB)
+	m, err := volume.GetProperty("mute")
+	if err != nil {
+		return a, err
+	}
+	a.Mute = m.(bool)
+	if amplify != nil {
+		v, err := amplify.GetProperty("amplification")
+		if err != nil {
+			return a, err
+		}
+		a.Amplification = float64(v.(float32))
+	}
+	return a, nil
+}
+
+// Apply an update to the elements of an audio input
+func (p *pipeline) updateAudioInput(name string, u audioInputUpdate) error {
+	volume, amplify, err := p.audioInputElements(name)
+	if err != nil {
+		return err
+	}
+	if u.amplification != nil && amplify == nil {
+		return fmt.Errorf("%w: audio input '%s' does not support amplification", errUnsupportedAudioSetting, name)
+	}
+
+	if u.mute != nil {
+		if err := volume.SetProperty("mute", *u.mute); err != nil {
+			return err
+		}
+	}
+	if u.gainDB != nil {
+		if err := volume.SetProperty("volume", dbToAmplitude(*u.gainDB)); err != nil {
+			return err
+		}
+	}
+	if u.amplification != nil {
+		if err := amplify.SetProperty("amplification", float32(*u.amplification)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Change the settings of an audio input at runtime and persist them. Returns
+// the settings after the update.
+func (d *daemon) updateAudioInput(name string, u audioInputUpdate) (audioInputState, error) {
+	d.mu.RLock()
+	p := d.pipeline
+	d.mu.RUnlock()
+	if p == nil {
+		return audioInputState{}, errPipelineNotConstructed
+	}
+
+	if err := p.updateAudioInput(name, u); err != nil {
+		return audioInputState{}, err
+	}
+	a, err := p.audioInputState(name)
+	if err != nil {
+		return a, err
+	}
+	if err := d.state.setAudioInput(name, a); err != nil {
+		klog.Errorf("failed to persist settings of audio input '%s': %v", name, err)
+	}
+	return a, nil
+}
+
+// Apply the persisted settings to the configuration of the audio inputs.
+// Called before the pipeline is constructed.
+func (c *daemonConfig) applyPersistedAudioState(state *stateStore) {
+	for i := range c.audioInputs {
+		in := &c.audioInputs[i]
+		a, ok := state.audioInput(in.name)
+		if !ok || in.mapped() {
+			continue
+		}
+		klog.Infof("restoring settings of audio input '%s': mute=%t gain=%.1fdB amplification=%.2f", in.name, a.Mute, a.GainDB, a.Amplification)
+		in.mute = a.Mute
+		in.gainDB = a.GainDB
+		in.amplification = a.Amplification
+	}
+}
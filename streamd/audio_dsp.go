@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+// Noise suppression levels of webrtcdsp in increasing order
+var noiseSuppressionLevels = []string{"low", "moderate", "high", "very-high"}
+
+// Returns whether any stage of webrtcdsp is enabled
+func (p *audioProcessing) dspEnabled() bool {
+	return p.NoiseSuppression != "" || p.GainControl || p.EchoCancel
+}
+
+// Returns the name of the webrtcechoprobe in the bin of a mix
+func echoProbeName(mixBin string) string {
+	return "webrtcechoprobe_" + mixBin
+}
+
+// Returns the description of a webrtcdsp element. webrtcdsp enables all
+// stages by default, so disabled stages are turned off explicitly.
+func webrtcDSPDesc(name string, p audioProcessing) string {
+	level := p.NoiseSuppression
+	if level == "" {
+		level = "moderate"
+	}
+	desc := fmt.Sprintf(
+		"webrtcdsp name=webrtcdsp_%s noise-suppression=%t noise-suppression-level=%s gain-control=%t echo-cancel=%t voice-detection=true",
+		name, p.NoiseSuppression != "", level, p.GainControl, p.EchoCancel,
+	)
+	if p.EchoCancel {
+		// The delay between the reference and the echo picked up by the
+		// microphone depends on the PA system and is estimated by webrtcdsp
+		desc += fmt.Sprintf(" probe=%s delay-agnostic=true", echoProbeName("mix_"+p.EchoReferenceMix))
+	}
+	return desc
+}
+
+// Fill in the default echo reference of the inputs and validate it. The
+// reference must not contain the input itself, as its signal would be
+// cancelled. It defaults to the mix routed to the combined output or else
+// the first mix without the input. The default mix of all inputs always
+// contains the input, so a mix without it must be created with -audio-mix.
+func (c *daemonConfig) resolveEchoReferences() error {
+	for i := range c.audioInputs {
+		in := &c.audioInputs[i]
+		if !in.processing.EchoCancel {
+			continue
+		}
+		if in.processing.EchoReferenceMix == "" {
+			combined := c.audioRoutes[outputCombined][0]
+			for _, mix := range c.audioMixes {
+				if !slices.Contains(mix.inputs, in.name) && (in.processing.EchoReferenceMix == "" || mix.name == combined) {
+					in.processing.EchoReferenceMix = mix.name
+				}
+			}
+			if in.processing.EchoReferenceMix == "" {
+				return fmt.Errorf("echo cancellation of audio input '%s' requires a mix without the input as reference, create one with -audio-mix", in.name)
+			}
+		}
+		j := slices.IndexFunc(c.audioMixes, func(mix audioMixConfig) bool { return mix.name == in.processing.EchoReferenceMix })
+		if j < 0 {
+			return fmt.Errorf("echo reference of audio input '%s' references unknown mix '%s'", in.name, in.processing.EchoReferenceMix)
+		}
+		if slices.Contains(c.audioMixes[j].inputs, in.name) {
+			return fmt.Errorf("echo reference of audio input '%s' must not contain the input, use -audio-mix to create a mix without it", in.name)
+		}
+	}
+	return nil
+}
+
+// audioDSPStats is the configuration and voice activity of the webrtcdsp of
+// an audio source
+type audioDSPStats struct {
+	noiseSuppression string
+	gainControl      bool
+	echoCancel       bool
+	// whether webrtcdsp detected voice in the most recent audio
+	voice bool
+}
+
+// Returns the noise suppression level starting at 1 for 'low', 0 if disabled
+func (s *audioDSPStats) noiseSuppressionLevel() int {
+	return slices.Index(noiseSuppressionLevels, s.noiseSuppression) + 1
+}
+
+// Record the webrtcdsp configuration of all audio inputs that use it. Must be
+// called with mu held.
+func (d *daemon) initAudioDSPStats() {
+	for _, in := range d.audioInputs {
+		if !in.processing.dspEnabled() {
+			continue
+		}
+		a := d.metrics.audio[in.name]
+		a.dsp = &audioDSPStats{
+			noiseSuppression: in.processing.NoiseSuppression,
+			gainControl:      in.processing.GainControl,
+			echoCancel:       in.processing.EchoCancel,
+		}
+		d.metrics.audio[in.name] = a
+	}
+}
+
+// Record a 'voice-activity' message of a webrtcdsp element. Called from the
+// bus watch.
+func (d *daemon) handleVoiceActivityMessage(element string, s *gst.Structure) {
+	source, ok := d.pipeline.audioSources[strings.TrimPrefix(element, "webrtcdsp_")]
+	if !ok {
+		return
+	}
+	var voice bool
+	if valueTo(s, "stream-has-voice", &voice) != nil {
+		return
+	}
+
+	d.mu.Lock()
+	a := d.metrics.audio[source]
+	if a.dsp != nil {
+		dsp := *a.dsp
+		dsp.voice = voice
+		a.dsp = &dsp
+		d.metrics.audio[source] = a
+	}
+	d.mu.Unlock()
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/go-gst/go-gst/gst"
+	"k8s.io/klog"
+)
+
+const (
+	// interval at which the level elements post their measurements
+	audioLevelInterval = 100 * time.Millisecond
+	// levels are clamped to this value, as digital silence is -Inf dBFS
+	audioLevelFloorDB = -200.0
+
+	audioAlertSilence  = "silence"
+	audioAlertClipping = "clipping"
+
+	audioAlertWebhookTimeout = 5 * time.Second
+)
+
+// Returns the description of a level element to be appended to an audio
+// source bin
+func audioLevelDesc(name string) string {
+	return fmt.Sprintf("level name=level_%s interval=%d post-messages=true", name, audioLevelInterval.Nanoseconds())
+}
+
+// levelDetector reports a condition once it has been met for a duration
+type levelDetector struct {
+	since  time.Time // start of the condition, zero if not met
+	active bool
+	events uint64
+}
+
+// Returns true if the detector became active or inactive. A duration of 0
+// disables the detector.
+func (t *levelDetector) update(met bool, now time.Time, duration time.Duration) bool {
+	if duration <= 0 {
+		return false
+	}
+	if !met {
+		t.since = time.Time{}
+		if t.active {
+			t.active = false
+			return true
+		}
+		return false
+	}
+
+	if t.since.IsZero() {
+		t.since = now
+	}
+	if !t.active && now.Sub(t.since) >= duration {
+		t.active = true
+		t.events++
+		return true
+	}
+	return false
+}
+
+// audioStats holds the most recent level of an audio source and the state of
+// its silence and clipping detectors. Updated by the bus watch.
+type audioStats struct {
+	time time.Time
+	// per channel in dBFS. The slices are replaced on every update and never
+	// modified in place.
+	rmsDB  []float64
+	peakDB []float64
+
+	silence  levelDetector
+	clipping levelDetector
+
+	// nil unless audio processing is enabled for the source. Replaced on
+	// every update.
+	loudness *loudness
+	// nil unless webrtcdsp is enabled for the source. Replaced on every
+	// update.
+	dsp *audioDSPStats
+}
+
+// An audioAlert is logged and posted to the webhook when a detector becomes
+// active or inactive
+type audioAlert struct {
+	Source string `json:"source"`
+	Alert  string `json:"alert"`
+	Active bool   `json:"active"`
+	// start of the condition
+	Since time.Time `json:"since"`
+	Time  time.Time `json:"time"`
+	// RMS level for silence, peak level for clipping
+	LevelDB float64 `json:"levelDb"`
+}
+
+// Retrieve the per channel values of a level message field
+func levelValues(s *gst.Structure, name string) ([]float64, error) {
+	var ptr unsafe.Pointer
+	if err := valueTo(s, name, &ptr); err != nil {
+		return nil, err
+	}
+	arr, err := convertGValueArray(ptr)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, 0, len(arr))
+	for _, v := range arr {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("failed to cast value of '%s' to float64", name)
+		}
+		values = append(values, max(f, audioLevelFloorDB))
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("'%s' has no channels", name)
+	}
+	return values, nil
+}
+
+// Record a message of a level element and run the detectors. Called from the
+// bus watch.
+func (d *daemon) handleLevelMessage(element string, s *gst.Structure) {
+	source, ok := d.pipeline.audioSources[strings.TrimPrefix(element, "level_")]
+	if !ok {
+		return
+	}
+	rms, err := levelValues(s, "rms")
+	if err != nil {
+		klog.Warningf("failed to parse level message from '%s': %v", element, err)
+		return
+	}
+	peak, err := levelValues(s, "peak")
+	if err != nil {
+		klog.Warningf("failed to parse level message from '%s': %v", element, err)
+		return
+	}
+	maxRMS := slices.Max(rms)
+	maxPeak := slices.Max(peak)
+	now := time.Now()
+
+	d.mu.Lock()
+	a := d.metrics.audio[source]
+	prevSilence, prevClipping := a.silence, a.clipping
+	a.time = now
+	a.rmsDB = rms
+	a.peakDB = peak
+	// A source is silent if all of its channels are
+	silenceChanged := a.silence.update(maxRMS < d.audioSilenceThresholdDB, now, d.audioSilenceDuration)
+	clippingChanged := a.clipping.update(maxPeak >= d.audioClippingThresholdDB, now, d.audioClippingDuration)
+	d.metrics.audio[source] = a
+	d.mu.Unlock()
+
+	d.updateMultiviewMeters()
+	if silenceChanged {
+		d.raiseAudioAlert(newAudioAlert(source, audioAlertSilence, &prevSilence, &a.silence, maxRMS, now))
+	}
+	if clippingChanged {
+		d.raiseAudioAlert(newAudioAlert(source, audioAlertClipping, &prevClipping, &a.clipping, maxPeak, now))
+	}
+}
+
+func newAudioAlert(source string, alert string, prev *levelDetector, cur *levelDetector, levelDB float64, now time.Time) audioAlert {
+	a := audioAlert{Source: source, Alert: alert, Active: cur.active, Since: cur.since, Time: now, LevelDB: levelDB}
+	// The start of the condition has been reset when it ended
+	if !cur.active {
+		a.Since = prev.since
+	}
+	return a
+}
+
+func (d *daemon) raiseAudioAlert(a audioAlert) {
+	if a.Active {
+		klog.Warningf("audio source '%s': %s for %s (%.1f dBFS)", a.Source, a.Alert, a.Time.Sub(a.Since).Round(time.Second), a.LevelDB)
+	} else {
+		klog.Infof("audio source '%s': %s ended after %s", a.Source, a.Alert, a.Time.Sub(a.Since).Round(time.Second))
+	}
+
+	if d.audioAlertWebhook != "" {
+		go postAudioAlert(d.audioAlertWebhook, a)
+	}
+}
+
+func postAudioAlert(url string, a audioAlert) {
+	body, err := json.Marshal(a)
+	if err != nil {
+		klog.Errorf("failed to encode audio alert: %v", err)
+		return
+	}
+
+	client := http.Client{Timeout: audioAlertWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		klog.Warningf("failed to post audio alert to webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		klog.Warningf("audio alert webhook responded with %s", resp.Status)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Names of the outputs audio mixes can be routed to
+const (
+	outputCombined  = "combined"
+	outputPresent   = "present"
+	outputCamera    = "camera"
+	outputMultiview = "multiview"
+	outputAudio     = "audio"
+
+	// name of the mix of all inputs if no mix is configured
+	defaultAudioMix = "master"
+)
+
+var audioOutputs = []string{outputCombined, outputPresent, outputCamera, outputMultiview, outputAudio}
+
+// Names of audio inputs and mixes are used in element names
+var audioNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// Languages of audio tracks are ISO 639-2 codes, as required by MPEG-TS and
+// Matroska
+var audioLanguageRegexp = regexp.MustCompile(`^[a-z]{3}$`)
+
+// audioInputConfig configures an audio input of the mixer
+type audioInputConfig struct {
+	name    string
+	factory string
+	opts    string
+
+	gainDB float64
+	// applied by the ALSA source bin only
+	amplification float64
+	// -1 (left) to 1 (right)
+	pan  float64
+	mute bool
+
+	processing audioProcessing
+
+	// number of channels captured by an input whose channels are mapped to
+	// other inputs. 0 if the input is not mapped and converted to stereo.
+	channels int
+	// input whose channels are taken by this input, and their 0-based
+	// indices. Empty if the input captures itself.
+	mapFrom     string
+	mapChannels []int
+}
+
+// Returns whether the channels of the input are mapped to other inputs. Such
+// an input is not mixed itself.
+func (in *audioInputConfig) mapped() bool {
+	return in.channels > 0
+}
+
+// audioChannelMap distributes the channels of an input to new inputs
+type audioChannelMap struct {
+	input    string
+	channels int
+	inputs   []audioInputConfig
+}
+
+// Numbers of channels supported by decklinkaudiosrc
+var decklinkAudioChannels = []int{2, 8, 16}
+
+// Maximum number of channels of a mapped input. Mapped inputs are mixed in
+// stereo.
+const audioMappedInputMaxChannels = 2
+
+// audioMixConfig configures a mix of audio inputs
+type audioMixConfig struct {
+	name   string
+	inputs []string
+	// ISO 639-2 code of the language of the mix. Empty if undetermined.
+	language string
+}
+
+// audioTrack is an audio track of a muxed output
+type audioTrack struct {
+	title    string
+	language string
+}
+
+// Parse '<name>:<factory>[:<properties>]', e.g. 'mic:alsasrc:device=hw:1'
+func parseAudioInput(spec string) (audioInputConfig, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 {
+		return audioInputConfig{}, fmt.Errorf("invalid audio input '%s': expected '<name>:<factory>[:<properties>]'", spec)
+	}
+	in := audioInputConfig{name: parts[0], factory: parts[1]}
+	if len(parts) == 3 {
+		in.opts = parts[2]
+	}
+	return in, nil
+}
+
+// Apply '<name>:<setting>[,<setting>...]' to the input of that name. Settings
+// are 'gain=<dB>', 'pan=<-1..1>', 'mute', and the stages of the audio
+// processing chain.
+func applyAudioInputSettings(inputs []audioInputConfig, spec string) error {
+	name, settings, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("invalid audio input settings '%s': expected '<name>:<setting>[,<setting>...]'", spec)
+	}
+	i := slices.IndexFunc(inputs, func(in audioInputConfig) bool { return in.name == name })
+	if i < 0 {
+		return fmt.Errorf("invalid audio input settings '%s': unknown input '%s'", spec, name)
+	}
+	in := &inputs[i]
+
+	for _, setting := range strings.Split(settings, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+
+		var err error
+		switch key {
+		case "gain":
+			in.gainDB, err = strconv.ParseFloat(value, 64)
+			if err == nil && (in.gainDB < audioGainMinDB || in.gainDB > audioGainMaxDB) {
+				err = fmt.Errorf("gain must be between %g and %g dB", audioGainMinDB, audioGainMaxDB)
+			}
+		case "pan":
+			in.pan, err = strconv.ParseFloat(value, 64)
+			if err == nil && (in.pan < -1 || in.pan > 1) {
+				err = fmt.Errorf("pan must be between -1 and 1")
+			}
+		case "mute":
+			in.mute = true
+		default:
+			err = in.processing.parseStage(key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid audio input setting '%s': %w", setting, err)
+		}
+	}
+	return nil
+}
+
+// Parse '<input>:<channels>:<name>=<channel>[+<channel>][,...]', e.g.
+// 'deck:16:mic=3,hdmi=5+6'. Channels are numbered from 1.
+func parseAudioChannelMap(spec string) (audioChannelMap, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 {
+		return audioChannelMap{}, fmt.Errorf("invalid audio channel map '%s': expected '<input>:<channels>:<name>=<channel>[+<channel>][,...]'", spec)
+	}
+	m := audioChannelMap{input: parts[0]}
+	var err error
+	m.channels, err = strconv.Atoi(parts[1])
+	if err != nil || m.channels < 1 {
+		return m, fmt.Errorf("invalid audio channel map '%s': invalid number of channels '%s'", spec, parts[1])
+	}
+
+	for _, mapping := range strings.Split(parts[2], ",") {
+		name, channels, ok := strings.Cut(strings.TrimSpace(mapping), "=")
+		if !ok {
+			return m, fmt.Errorf("invalid audio channel mapping '%s': expected '<name>=<channel>[+<channel>]'", mapping)
+		}
+		in := audioInputConfig{name: name, mapFrom: m.input}
+		for _, c := range strings.Split(channels, "+") {
+			ch, err := strconv.Atoi(c)
+			if err != nil || ch < 1 || ch > m.channels {
+				return m, fmt.Errorf("invalid audio channel mapping '%s': channel must be between 1 and %d", mapping, m.channels)
+			}
+			in.mapChannels = append(in.mapChannels, ch-1)
+		}
+		if len(in.mapChannels) > audioMappedInputMaxChannels {
+			return m, fmt.Errorf("invalid audio channel mapping '%s': at most %d channels can be mapped to an input", mapping, audioMappedInputMaxChannels)
+		}
+		m.inputs = append(m.inputs, in)
+	}
+	return m, nil
+}
+
+// Replace the mapped inputs by the inputs their channels are mapped to. The
+// mapped input is kept in front of them to capture the channels.
+func applyAudioChannelMap(inputs []audioInputConfig, m audioChannelMap) ([]audioInputConfig, error) {
+	i := slices.IndexFunc(inputs, func(in audioInputConfig) bool { return in.name == m.input })
+	if i < 0 {
+		return nil, fmt.Errorf("audio channel map references unknown input '%s'", m.input)
+	}
+	if inputs[i].mapped() || inputs[i].mapFrom != "" {
+		return nil, fmt.Errorf("channels of audio input '%s' are mapped twice", m.input)
+	}
+	inputs[i].channels = m.channels
+	return slices.Insert(inputs, i+1, m.inputs...), nil
+}
+
+// Parse '<name>:<input>[,<input>...]'
+func parseAudioMix(spec string) (audioMixConfig, error) {
+	name, inputs, ok := strings.Cut(spec, ":")
+	if !ok || inputs == "" {
+		return audioMixConfig{}, fmt.Errorf("invalid audio mix '%s': expected '<name>:<input>[,<input>...]'", spec)
+	}
+	return audioMixConfig{name: name, inputs: strings.Split(inputs, ",")}, nil
+}
+
+// Parse '<output>:<mix>[,<mix>...]' into routes
+func parseAudioRoute(routes map[string][]string, spec string) error {
+	output, mixes, ok := strings.Cut(spec, ":")
+	if !ok || mixes == "" {
+		return fmt.Errorf("invalid audio route '%s': expected '<output>:<mix>[,<mix>...]'", spec)
+	}
+	if !slices.Contains(audioOutputs, output) {
+		return fmt.Errorf("invalid audio route '%s': unknown output '%s'", spec, output)
+	}
+	routes[output] = strings.Split(mixes, ",")
+	return nil
+}
+
+// Parse '<mix>:<language>' into languages
+func parseAudioLanguage(languages map[string]string, spec string) error {
+	mix, language, ok := strings.Cut(spec, ":")
+	if !ok || !audioLanguageRegexp.MatchString(language) {
+		return fmt.Errorf("invalid audio language '%s': expected '<mix>:<ISO 639-2 code>', e.g. 'interpreter:eng'", spec)
+	}
+	languages[mix] = language
+	return nil
+}
+
+// Fill in the defaults of the audio configuration and validate it. Without
+// -audio-input, -source-audio is the only input. Channel maps add the inputs
+// their channels are mapped to. Without -audio-mix, all
+// inputs are mixed into a single mix, which is routed to every output without
+// a route.
+func (c *daemonConfig) resolveAudioConfig() error {
+	if len(c.audioInputs) > 0 && c.audioProcessing.enabled() {
+		return fmt.Errorf("-audio-processing only applies to -source-audio, use -audio-input-settings instead")
+	}
+	if len(c.audioInputs) == 0 {
+		c.audioInputs = []audioInputConfig{{
+			name:       sourceAudio,
+			factory:    c.sourceAudio,
+			opts:       c.sourceAudioOpts,
+			processing: c.audioProcessing,
+		}}
+	}
+	for i := range c.audioInputs {
+		c.audioInputs[i].amplification = c.audioAmplification
+	}
+	for _, m := range c.audioChannelMaps {
+		var err error
+		if c.audioInputs, err = applyAudioChannelMap(c.audioInputs, m); err != nil {
+			return err
+		}
+	}
+	for _, spec := range c.audioInputSettings {
+		if err := applyAudioInputSettings(c.audioInputs, spec); err != nil {
+			return err
+		}
+	}
+
+	inputs := make(map[string]bool)
+	for _, in := range c.audioInputs {
+		if !audioNameRegexp.MatchString(in.name) {
+			return fmt.Errorf("invalid audio input name '%s': only letters and digits are allowed", in.name)
+		}
+		if in.name == sourceCamera || in.name == sourcePresent || inputs[in.name] {
+			return fmt.Errorf("duplicate source name '%s'", in.name)
+		}
+		inputs[in.name] = true
+
+		// Mapped inputs only capture, their settings apply to the inputs they
+		// are mapped to
+		if in.mapped() && (in.gainDB != 0 || in.pan != 0 || in.mute || in.processing.enabled()) {
+			return fmt.Errorf("audio input '%s' is mapped to other inputs and cannot be adjusted", in.name)
+		}
+		if in.mapped() && in.factory == "decklinkaudiosrc" && !slices.Contains(decklinkAudioChannels, in.channels) {
+			return fmt.Errorf("audio input '%s' is a decklinkaudiosrc, which captures 2, 8, or 16 channels, not %d", in.name, in.channels)
+		}
+	}
+
+	if len(c.audioMixes) == 0 {
+		mix := audioMixConfig{name: defaultAudioMix}
+		for _, in := range c.audioInputs {
+			if !in.mapped() {
+				mix.inputs = append(mix.inputs, in.name)
+			}
+		}
+		c.audioMixes = []audioMixConfig{mix}
+	}
+
+	mixes := make(map[string]bool)
+	used := make(map[string]bool)
+	for _, mix := range c.audioMixes {
+		if !audioNameRegexp.MatchString(mix.name) {
+			return fmt.Errorf("invalid audio mix name '%s': only letters and digits are allowed", mix.name)
+		}
+		if mixes[mix.name] {
+			return fmt.Errorf("duplicate audio mix '%s'", mix.name)
+		}
+		mixes[mix.name] = true
+		for _, in := range mix.inputs {
+			if !inputs[in] {
+				return fmt.Errorf("audio mix '%s' references unknown input '%s'", mix.name, in)
+			}
+			if slices.ContainsFunc(c.audioInputs, func(i audioInputConfig) bool { return i.name == in && i.mapped() }) {
+				return fmt.Errorf("audio mix '%s' references input '%s' whose channels are mapped to other inputs", mix.name, in)
+			}
+			used[in] = true
+		}
+	}
+	for _, in := range c.audioInputs {
+		if !in.mapped() && !used[in.name] {
+			return fmt.Errorf("audio input '%s' is not part of any mix", in.name)
+		}
+	}
+
+	for name, language := range c.audioLanguages {
+		i := slices.IndexFunc(c.audioMixes, func(mix audioMixConfig) bool { return mix.name == name })
+		if i < 0 {
+			return fmt.Errorf("audio language references unknown mix '%s'", name)
+		}
+		c.audioMixes[i].language = language
+	}
+
+	if c.audioRoutes == nil {
+		c.audioRoutes = make(map[string][]string)
+	}
+	for _, output := range audioOutputs {
+		routed, ok := c.audioRoutes[output]
+		if !ok {
+			c.audioRoutes[output] = []string{c.audioMixes[0].name}
+			continue
+		}
+		for i, mix := range routed {
+			if !mixes[mix] {
+				return fmt.Errorf("audio route for '%s' references unknown mix '%s'", output, mix)
+			}
+			if slices.Index(routed, mix) != i {
+				return fmt.Errorf("audio route for '%s' contains mix '%s' twice", output, mix)
+			}
+		}
+	}
+	for _, mix := range c.audioMixes {
+		if !c.audioMixRouted(mix.name) {
+			return fmt.Errorf("audio mix '%s' is not routed to any output", mix.name)
+		}
+	}
+
+	return c.resolveEchoReferences()
+}
+
+// Returns whether a mix is routed to an enabled output
+func (c *daemonConfig) audioMixRouted(mix string) bool {
+	for output, mixes := range c.audioRoutes {
+		for track, m := range mixes {
+			if m == mix && c.audioOutputBranches(output, track) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the number of branches a track of an output requires from its mix,
+// 0 if the output is disabled. HLS and Icecast only carry the first track.
+func (c *daemonConfig) audioOutputBranches(output string, track int) int {
+	switch output {
+	case outputMultiview:
+		if !c.multiview {
+			return 0
+		}
+		if c.multiviewHLSDir != "" && track == 0 {
+			return 2
+		}
+		return 1
+	case outputAudio:
+		n := 0
+		if c.audioOutput {
+			n++
+		}
+		if c.audioOutputIcecast != nil && track == 0 {
+			n++
+		}
+		return n
+	default:
+		return 1
+	}
+}
+
+// Returns the audio tracks of an output, one for every mix routed to it
+func (c *daemonConfig) audioTracks(output string) []audioTrack {
+	var tracks []audioTrack
+	for _, name := range c.audioRoutes[output] {
+		i := slices.IndexFunc(c.audioMixes, func(mix audioMixConfig) bool { return mix.name == name })
+		tracks = append(tracks, audioTrack{title: name, language: c.audioMixes[i].language})
+	}
+	return tracks
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Encodings of an Icecast mount, chosen by the extension of the mount point
+const (
+	icecastFormatOgg = "ogg"
+	icecastFormatMP3 = "mp3"
+)
+
+// Environment variable holding the password of the Icecast mount if no
+// password file is given
+const icecastPasswordEnv = "STREAMD_ICECAST_PASSWORD"
+
+// icecastConfig configures the Icecast mount the audio output is streamed to
+type icecastConfig struct {
+	host     string
+	port     int
+	mount    string
+	username string
+	password string
+	format   string
+}
+
+// Parse 'icecast://[<user>@]<host>[:<port>]/<mount>', e.g.
+// 'icecast://source@localhost:8000/lecture.ogg'. Mounts ending in '.mp3' are
+// encoded to MP3, all others to Opus in Ogg. The password is not part of the
+// URL, as command lines are visible to all users.
+func parseIcecastURL(s string) (*icecastConfig, error) {
+	// Errors must not contain the password
+	u, err := url.Parse(s)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("invalid Icecast URL: %w", err)
+	}
+	if u.Scheme != "icecast" || u.Hostname() == "" || u.Path == "" || u.Path == "/" {
+		return nil, fmt.Errorf("invalid Icecast URL '%s': expected 'icecast://[<user>@]<host>[:<port>]/<mount>'", u.Redacted())
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, fmt.Errorf("invalid Icecast URL '%s': pass the password with -audio-output-icecast-password-file or $%s", u.Redacted(), icecastPasswordEnv)
+	}
+
+	c := &icecastConfig{
+		host:     u.Hostname(),
+		port:     8000,
+		mount:    u.Path,
+		username: "source",
+		format:   icecastFormatOgg,
+	}
+	if p := u.Port(); p != "" {
+		c.port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Icecast URL '%s': %w", u.Redacted(), err)
+		}
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+	}
+	if path.Ext(u.Path) == ".mp3" {
+		c.format = icecastFormatMP3
+	}
+	return c, nil
+}
+
+// Read the password of the mount from file, or from $STREAMD_ICECAST_PASSWORD
+// if file is empty
+func (c *icecastConfig) loadPassword(file string) error {
+	if file == "" {
+		c.password = os.Getenv(icecastPasswordEnv)
+	} else {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read Icecast password: %w", err)
+		}
+		c.password = strings.TrimRight(string(data), "\r\n")
+	}
+	if c.password == "" {
+		return fmt.Errorf("the Icecast output requires a password from -audio-output-icecast-password-file or $%s", icecastPasswordEnv)
+	}
+	return nil
+}
+
+// Returns the strings that must not appear in filter graphs, as parameters of
+// elements are included in them
+func (c *daemonConfig) graphSecrets() []string {
+	if c.audioOutputIcecast == nil {
+		return nil
+	}
+	return []string{c.audioOutputIcecast.password}
+}
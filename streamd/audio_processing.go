@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+// audioProcessing configures the optional processing chain of an audio
+// source. Stages are applied in the order of the fields. A zero value
+// disables the respective stage.
+type audioProcessing struct {
+	// noise suppression level of webrtcdsp (low, moderate, high, very-high).
+	// Empty if disabled.
+	NoiseSuppression string
+	// whether webrtcdsp adapts the gain to the level of speech
+	GainControl bool
+	// whether webrtcdsp cancels the echo of EchoReferenceMix, the mix played
+	// back into the room. Defaults to the mix routed to the combined output
+	// if it does not contain the input, or else the first mix without it.
+	EchoCancel       bool
+	EchoReferenceMix string
+	// cutoff frequency of the high-pass filter
+	HighpassHz float64
+	// level below which the signal is attenuated (noise gate), in dBFS
+	GateThresholdDB float64
+	// level above which the signal is compressed by CompressorRatio, in dBFS
+	CompressorThresholdDB float64
+	CompressorRatio       float64
+	// whether to limit peaks to 0 dBFS
+	Limiter bool
+	// integrated loudness to normalise to, in LUFS
+	LoudnessTargetLUFS float64
+}
+
+// Ratio by which the signal is attenuated below the gate threshold
+const audioGateRatio = 10
+
+// Returns whether any stage is enabled
+func (p *audioProcessing) enabled() bool {
+	return *p != audioProcessing{}
+}
+
+// Parse a comma separated list of processing stages, e.g.
+// 'denoise=high,agc,aec,highpass=80,gate=-50,compressor=-18:4,limiter,loudness=-23'
+func parseAudioProcessing(spec string) (audioProcessing, error) {
+	var p audioProcessing
+	if spec == "" {
+		return p, nil
+	}
+
+	for _, stage := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(stage), "=")
+		if err := p.parseStage(key, value); err != nil {
+			return p, fmt.Errorf("invalid audio processing stage '%s': %w", stage, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Parse a single processing stage given as key and value
+func (p *audioProcessing) parseStage(key string, value string) error {
+	var err error
+	switch key {
+	case "denoise":
+		if value == "" {
+			value = "moderate"
+		}
+		if !slices.Contains(noiseSuppressionLevels, value) {
+			return fmt.Errorf("level must be one of %s", strings.Join(noiseSuppressionLevels, ", "))
+		}
+		p.NoiseSuppression = value
+	case "agc":
+		p.GainControl = true
+	case "aec":
+		p.EchoCancel = true
+		p.EchoReferenceMix = value
+	case "highpass":
+		p.HighpassHz, err = strconv.ParseFloat(value, 64)
+		if err == nil && p.HighpassHz <= 0 {
+			err = fmt.Errorf("cutoff must be positive")
+		}
+	case "gate":
+		p.GateThresholdDB, err = strconv.ParseFloat(value, 64)
+		if err == nil && p.GateThresholdDB >= 0 {
+			err = fmt.Errorf("threshold must be negative")
+		}
+	case "compressor":
+		threshold, ratio, ok := strings.Cut(value, ":")
+		if !ok {
+			return fmt.Errorf("expected '<threshold>:<ratio>'")
+		}
+		p.CompressorThresholdDB, err = strconv.ParseFloat(threshold, 64)
+		if err != nil {
+			return err
+		}
+		p.CompressorRatio, err = strconv.ParseFloat(ratio, 64)
+		if err == nil && (p.CompressorThresholdDB >= 0 || p.CompressorRatio <= 1) {
+			err = fmt.Errorf("threshold must be negative and ratio greater than 1")
+		}
+	case "limiter":
+		p.Limiter = true
+	case "loudness":
+		p.LoudnessTargetLUFS, err = strconv.ParseFloat(value, 64)
+		// Range supported by audioloudnorm
+		if err == nil && (p.LoudnessTargetLUFS < -70 || p.LoudnessTargetLUFS > -5) {
+			err = fmt.Errorf("target must be between -70 and -5 LUFS")
+		}
+	default:
+		err = fmt.Errorf("unknown setting '%s'", key)
+	}
+	return err
+}
+
+func dbToAmplitude(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// Returns the description of the processing chain to be inserted into an
+// audio source bin, ending in ' ! ', or an empty string if processing is
+// disabled. The chain converts back to caps and ends in an ebur128level
+// element measuring the loudness of the processed signal.
+func audioProcessingDesc(name string, p audioProcessing, caps audioCapsFilter) string {
+	if !p.enabled() {
+		return ""
+	}
+
+	stages := []string{fmt.Sprintf("audioconvert name=audioconvert_proc_%s", name)}
+	if p.dspEnabled() {
+		stages = append(stages, webrtcDSPDesc(name, p))
+	}
+	if p.HighpassHz > 0 {
+		stages = append(stages, fmt.Sprintf("audiocheblimit name=highpass_%s mode=high-pass cutoff=%f poles=4", name, p.HighpassHz))
+	}
+	if p.GateThresholdDB < 0 {
+		stages = append(stages, fmt.Sprintf(
+			"audiodynamic name=gate_%s mode=expander characteristics=hard-knee threshold=%f ratio=%d",
+			name, dbToAmplitude(p.GateThresholdDB), audioGateRatio,
+		))
+	}
+	if p.CompressorRatio > 1 {
+		// audiodynamic multiplies the signal above the threshold by ratio
+		stages = append(stages, fmt.Sprintf(
+			"audiodynamic name=compressor_%s mode=compressor characteristics=soft-knee threshold=%f ratio=%f",
+			name, dbToAmplitude(p.CompressorThresholdDB), 1/p.CompressorRatio,
+		))
+	}
+	if p.Limiter {
+		stages = append(stages, fmt.Sprintf("rglimiter name=limiter_%s", name))
+	}
+	if p.LoudnessTargetLUFS < 0 {
+		// audioloudnorm only accepts 192 kHz and adds a latency of 3s
+		stages = append(stages,
+			fmt.Sprintf("audioconvert name=audioconvert_loudnorm_%s", name),
+			fmt.Sprintf("audioresample name=audioresample_loudnorm_%s", name),
+			fmt.Sprintf("audioloudnorm name=loudnorm_%s loudness-target=%f", name, p.LoudnessTargetLUFS),
+		)
+	}
+	stages = append(stages,
+		fmt.Sprintf("audioconvert name=audioconvert_postproc_%s", name),
+		fmt.Sprintf("audioresample name=audioresample_postproc_%s", name),
+		fmt.Sprintf("capsfilter name=capsfilter_postproc_%s caps=%s", name, caps.string()),
+		fmt.Sprintf("ebur128level name=ebur128level_%s interval=%d post-messages=true", name, audioLevelInterval.Nanoseconds()),
+	)
+
+	return strings.Join(stages, " ! ") + " ! "
+}
+
+// loudness is the EBU R128 loudness of an audio source measured by ebur128level
+type loudness struct {
+	momentaryLUFS  float64
+	shortTermLUFS  float64
+	integratedLUFS float64
+	rangeLU        float64
+}
+
+// Retrieve the loudness from an 'ebur128-level' message. Missing fields are
+// left at the floor, as they depend on the mode of the element.
+func parseLoudness(s *gst.Structure) loudness {
+	l := loudness{
+		momentaryLUFS:  audioLevelFloorDB,
+		shortTermLUFS:  audioLevelFloorDB,
+		integratedLUFS: audioLevelFloorDB,
+	}
+	for _, field := range []struct {
+		dest *float64
+		name string
+	}{
+		{&l.momentaryLUFS, "momentary-loudness"},
+		{&l.shortTermLUFS, "shortterm-loudness"},
+		{&l.integratedLUFS, "global-loudness"},
+		{&l.rangeLU, "loudness-range"},
+	} {
+		var v float64
+		if valueTo(s, field.name, &v) == nil && !math.IsNaN(v) {
+			*field.dest = max(v, audioLevelFloorDB)
+		}
+	}
+	return l
+}
+
+// Record a message of an ebur128level element. Called from the bus watch.
+func (d *daemon) handleLoudnessMessage(element string, s *gst.Structure) {
+	source, ok := d.pipeline.audioSources[strings.TrimPrefix(element, "ebur128level_")]
+	if !ok {
+		return
+	}
+	l := parseLoudness(s)
+
+	d.mu.Lock()
+	a := d.metrics.audio[source]
+	a.loudness = &l
+	d.metrics.audio[source] = a
+	d.mu.Unlock()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+const (
+	// Offsets are limited by the queues in the source bins, which buffer up
+	// to one second.
+	maxAVOffset = time.Second
+
+	// interval of the flash and beep of the A/V sync test pattern
+	avSyncTestInterval = time.Second
+)
+
+var errUnknownSource = errors.New("unknown source")
+
+func validateAVOffset(offset time.Duration) error {
+	if offset < -maxAVOffset || offset > maxAVOffset {
+		return fmt.Errorf("offset must be between %d and %d ms", -maxAVOffset.Milliseconds(), maxAVOffset.Milliseconds())
+	}
+	return nil
+}
+
+// Parse '<source>:<ms>' into offsets
+func parseAVOffset(offsets map[string]time.Duration, spec string) error {
+	source, ms, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("invalid A/V offset '%s': expected '<source>:<ms>'", spec)
+	}
+	v, err := strconv.ParseFloat(ms, 64)
+	if err != nil {
+		return fmt.Errorf("invalid A/V offset '%s': %w", spec, err)
+	}
+	offset := time.Duration(v * float64(time.Millisecond))
+	if err := validateAVOffset(offset); err != nil {
+		return fmt.Errorf("invalid A/V offset '%s': %w", spec, err)
+	}
+	offsets[source] = offset
+	return nil
+}
+
+// Shift the timestamps of a source by offset. A positive offset delays the
+// source. Negative offsets must not exceed the latency of the pipeline, as
+// the buffers would arrive too late at the mixers.
+func (p *pipeline) setSourceOffset(source string, offset time.Duration) error {
+	bin, ok := p.sourceBins[source]
+	if !ok {
+		return errUnknownSource
+	}
+	pad := bin.GetStaticPad("src")
+	if pad == nil {
+		return fmt.Errorf("failed to get static pad 'src' from '%s' bin", bin.GetName())
+	}
+	pad.SetOffset(offset.Nanoseconds())
+	return nil
+}
+
+// Set the A/V offset of a source at runtime
+func (d *daemon) setSourceOffset(source string, offset time.Duration) error {
+	d.mu.RLock()
+	p := d.pipeline
+	d.mu.RUnlock()
+	if p == nil {
+		return errPipelineNotConstructed
+	}
+
+	return p.setSourceOffset(source, offset)
+}
+
+// Creates a VideoTestSourceBin showing a white frame at the start of every
+// avSyncTestInterval and black frames otherwise. Together with the beep of
+// the audio test source it allows to measure the A/V offset of the outputs.
+func newSyncTestVideoSourceBin(name string, caps videoCapsFilter) (*gst.Bin, error) {
+	bin, err := newVideoTestSourceBin(name, videoPatternWhite, caps)
+	if err != nil {
+		return nil, err
+	}
+	src, err := bin.GetElementByName("videotestsrc_" + name)
+	if err != nil {
+		return nil, err
+	}
+	pad := src.GetStaticPad("src")
+	if pad == nil {
+		return nil, fmt.Errorf("failed to get static pad 'src' from '%s'", src.GetName())
+	}
+
+	// The pattern applies from the next frame on, so it is chosen by the
+	// timestamp of the next frame
+	pad.AddProbe(gst.PadProbeTypeBuffer, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		buf := info.GetBuffer()
+		if buf == nil {
+			return gst.PadProbeOK
+		}
+		pts, duration := buf.PresentationTimestamp(), buf.Duration()
+		if pts == gst.ClockTimeNone || duration == gst.ClockTimeNone {
+			return gst.PadProbeOK
+		}
+		next := time.Duration(pts + duration)
+		pattern := videoPatternBlack
+		if next%avSyncTestInterval < time.Duration(duration) {
+			pattern = videoPatternWhite
+		}
+		src.SetArg("pattern", strconv.Itoa(int(pattern)))
+		return gst.PadProbeOK
+	})
+
+	return bin, nil
+}
+
+// Properties of audiotestsrc beeping at the start of every
+// avSyncTestInterval
+func audioSyncTestOpts() string {
+	return fmt.Sprintf("wave=ticks freq=1000 tick-interval=%d", avSyncTestInterval.Nanoseconds())
+}
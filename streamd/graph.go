@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+	"k8s.io/klog"
+)
+
+const (
+	graphFormatDOT = "dot"
+	graphFormatSVG = "svg"
+	graphFormatPNG = "png"
+
+	// number of filter graphs kept in memory
+	graphHistorySize = 32
+	// upper bound for a single graphviz invocation
+	graphRenderTimeout = 10 * time.Second
+)
+
+var errGraphvizUnavailable = errors.New("graphviz 'dot' binary not found in PATH, use format=svg or format=dot")
+
+// Content types of the supported graph formats
+var graphContentTypes = map[string]string{
+	graphFormatDOT: "text/vnd.graphviz",
+	graphFormatSVG: "image/svg+xml",
+	graphFormatPNG: "image/png",
+}
+
+// Render a filter graph in DOT format into format using the local graphviz
+// installation. Without graphviz, SVG is rendered with a simplified layout
+// and PNG is unavailable.
+func renderGraph(ctx context.Context, dot string, format string) ([]byte, error) {
+	if format == graphFormatDOT {
+		return []byte(dot), nil
+	}
+	if _, ok := graphContentTypes[format]; !ok {
+		return nil, fmt.Errorf("unsupported graph format '%s'", format)
+	}
+
+	path, err := exec.LookPath("dot")
+	if err != nil && format == graphFormatSVG {
+		return renderGraphSVG(dot)
+	} else if err != nil {
+		return nil, errGraphvizUnavailable
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, graphRenderTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "-T"+format)
+	cmd.Stdin = strings.NewReader(dot)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("dot failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// A graphSnapshot is the filter graph of the pipeline at a point in time
+type graphSnapshot struct {
+	id     uint64
+	time   time.Time
+	reason string // e.g. the state transition
+	dot    string
+}
+
+// graphHistory is a ring buffer of the last graphHistorySize filter graphs.
+// Graphs are optionally written to dir to survive a crash of the daemon.
+type graphHistory struct {
+	dir string
+	// redacted from the graphs
+	secrets []string
+
+	// mu guards the fields below.
+	mu      sync.Mutex
+	nextID  uint64
+	entries []graphSnapshot
+}
+
+func newGraphHistory(dir string, secrets []string) *graphHistory {
+	return &graphHistory{dir: dir, secrets: secrets}
+}
+
+// Replace every occurrence of secrets in a filter graph
+func redactSecrets(dot string, secrets []string) string {
+	for _, s := range secrets {
+		if s != "" {
+			dot = strings.ReplaceAll(dot, s, "[REDACTED]")
+		}
+	}
+	return dot
+}
+
+// Record the filter graph of bin
+func (g *graphHistory) record(bin *gst.Bin, reason string) {
+	snap := graphSnapshot{
+		time:   time.Now(),
+		reason: reason,
+		dot:    redactSecrets(bin.DebugBinToDotData(gst.DebugGraphShowAll), g.secrets),
+	}
+
+	g.mu.Lock()
+	snap.id = g.nextID
+	g.nextID++
+	g.entries = append(g.entries, snap)
+	if len(g.entries) > graphHistorySize {
+		g.entries = g.entries[1:]
+	}
+	g.mu.Unlock()
+
+	if g.dir == "" {
+		return
+	}
+	name := fmt.Sprintf("%s-%04d-%s.dot", snap.time.Format("20060102T150405.000"), snap.id, sanitizeFilename(reason))
+	if err := os.WriteFile(filepath.Join(g.dir, name), []byte(snap.dot), 0o644); err != nil {
+		klog.Warningf("failed to write filter graph to %s: %v", g.dir, err)
+	}
+}
+
+// Returns all graph snapshots, oldest first
+func (g *graphHistory) list() []graphSnapshot {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]graphSnapshot(nil), g.entries...)
+}
+
+// Returns the graph snapshot with the given id
+func (g *graphHistory) get(id uint64) (graphSnapshot, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, e := range g.entries {
+		if e.id == id {
+			return e, true
+		}
+	}
+	return graphSnapshot{}, false
+}
+
+func sanitizeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
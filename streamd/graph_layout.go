@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Fallback renderer for filter graphs if graphviz is not installed. The DOT
+// written by GStreamer is parsed into its clusters, pads, and links, and every
+// visible cluster owning pads (an element or a bin with ghost pads) is drawn
+// as a box. Boxes are arranged left to right in layers by the longest path
+// from the sources. Nesting of bins is not drawn.
+
+const (
+	layoutCharWidth  = 6
+	layoutLineHeight = 12
+	layoutPadding    = 6
+	layoutColumnGap  = 60
+	layoutRowGap     = 16
+	layoutMargin     = 10
+)
+
+// A dotCluster is a subgraph of the DOT, i.e. an element or bin
+type dotCluster struct {
+	label     string
+	invisible bool
+	parent    *dotCluster
+}
+
+// A dotNode is a pad of an element
+type dotNode struct {
+	id      string
+	cluster *dotCluster
+}
+
+type dotGraph struct {
+	nodes map[string]*dotNode
+	// ids of the nodes in order of appearance
+	order []string
+	edges [][2]string
+}
+
+// dotParser parses the subset of DOT written by gst_debug_bin_to_dot_data
+type dotParser struct {
+	tokens []string
+	pos    int
+	graph  *dotGraph
+}
+
+// Split DOT into identifiers, quoted strings (unquoted and unescaped), and the
+// punctuation '{', '}', '[', ']', '=', ';', ',', and '->'
+func tokenizeDOT(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"':
+			var b strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+					switch s[i] {
+					case 'n', 'l', 'r':
+						b.WriteByte('\n')
+					default:
+						b.WriteByte(s[i])
+					}
+					continue
+				}
+				b.WriteByte(s[i])
+			}
+			i++
+			// Quoted tokens are marked to distinguish them from punctuation
+			tokens = append(tokens, "\x00"+b.String())
+		case strings.HasPrefix(s[i:], "->"):
+			tokens = append(tokens, "->")
+			i += 2
+		case strings.ContainsRune("{}[]=;,", rune(c)):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("{}[]=;,\"", rune(s[j])) && !strings.HasPrefix(s[j:], "->") {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func (p *dotParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *dotParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// Returns the value of a token without the quoting mark
+func tokenValue(t string) string {
+	return strings.TrimPrefix(t, "\x00")
+}
+
+// Parse '[key=value, ...]'
+func (p *dotParser) attributes() map[string]string {
+	attrs := make(map[string]string)
+	if p.peek() != "[" {
+		return attrs
+	}
+	p.next()
+	for p.pos < len(p.tokens) && p.peek() != "]" {
+		key := tokenValue(p.next())
+		if p.peek() == "=" {
+			p.next()
+			attrs[key] = tokenValue(p.next())
+		}
+		if p.peek() == "," || p.peek() == ";" {
+			p.next()
+		}
+	}
+	p.next()
+	return attrs
+}
+
+// Parse the statements of a graph or subgraph up to its closing brace
+func (p *dotParser) statements(cluster *dotCluster) {
+	for p.pos < len(p.tokens) {
+		t := p.next()
+		switch {
+		case t == "}":
+			return
+		case t == ";":
+		case t == "subgraph":
+			p.next() // the id
+			p.next() // '{'
+			p.statements(&dotCluster{parent: cluster})
+		case t == "node" || t == "edge" || t == "graph":
+			p.attributes()
+		case p.peek() == "=":
+			p.next()
+			value := tokenValue(p.next())
+			if cluster == nil {
+				continue
+			}
+			switch t {
+			case "label":
+				cluster.label = value
+			case "style":
+				cluster.invisible = strings.Contains(value, "invis")
+			}
+		case p.peek() == "->":
+			p.next()
+			to := tokenValue(p.next())
+			p.attributes()
+			p.graph.edges = append(p.graph.edges, [2]string{tokenValue(t), to})
+		default:
+			id := tokenValue(t)
+			p.attributes()
+			if _, ok := p.graph.nodes[id]; !ok && id != "legend" {
+				p.graph.nodes[id] = &dotNode{id: id, cluster: cluster}
+				p.graph.order = append(p.graph.order, id)
+			}
+		}
+	}
+}
+
+func parseDOT(dot string) (*dotGraph, error) {
+	p := &dotParser{tokens: tokenizeDOT(dot), graph: &dotGraph{nodes: make(map[string]*dotNode)}}
+	for p.pos < len(p.tokens) && p.peek() != "{" {
+		p.next()
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("invalid DOT: no graph found")
+	}
+	p.next()
+	p.statements(nil)
+	return p.graph, nil
+}
+
+// A layoutBox is a visible cluster with pads placed in the SVG
+type layoutBox struct {
+	cluster *dotCluster
+	lines   []string
+	layer   int
+	x, y    int
+	w, h    int
+}
+
+// Returns the nearest visible cluster of a pad
+func visibleCluster(c *dotCluster) *dotCluster {
+	for c != nil && (c.invisible || c.label == "") {
+		c = c.parent
+	}
+	return c
+}
+
+// Render a filter graph in DOT format as SVG without graphviz
+func renderGraphSVG(dot string) ([]byte, error) {
+	g, err := parseDOT(dot)
+	if err != nil {
+		return nil, err
+	}
+
+	// Boxes in order of appearance in the DOT
+	var boxes []*layoutBox
+	byCluster := make(map[*dotCluster]*layoutBox)
+	boxOf := func(id string) *layoutBox {
+		n, ok := g.nodes[id]
+		if !ok {
+			return nil
+		}
+		c := visibleCluster(n.cluster)
+		if c == nil {
+			return nil
+		}
+		b, ok := byCluster[c]
+		if !ok {
+			// The type and name of the element, omitting its properties
+			lines := strings.Split(strings.TrimSpace(c.label), "\n")
+			b = &layoutBox{cluster: c, lines: lines[:min(len(lines), 2)]}
+			byCluster[c] = b
+			boxes = append(boxes, b)
+		}
+		return b
+	}
+	for _, id := range g.order {
+		boxOf(id)
+	}
+
+	// Links between boxes, without links within a box
+	succ := make(map[*layoutBox][]*layoutBox)
+	indeg := make(map[*layoutBox]int)
+	type link struct{ from, to *layoutBox }
+	var links []link
+	for _, e := range g.edges {
+		from, to := boxOf(e[0]), boxOf(e[1])
+		if from == nil || to == nil || from == to || slices.Contains(succ[from], to) {
+			continue
+		}
+		succ[from] = append(succ[from], to)
+		indeg[to]++
+		links = append(links, link{from, to})
+	}
+
+	// Assign layers by the longest path from the sources. Boxes in cycles
+	// are placed after their other predecessors.
+	queue := []*layoutBox{}
+	for _, b := range boxes {
+		if indeg[b] == 0 {
+			queue = append(queue, b)
+		}
+	}
+	visited := make(map[*layoutBox]bool)
+	for len(visited) < len(boxes) {
+		if len(queue) == 0 {
+			for _, b := range boxes {
+				if !visited[b] {
+					queue = append(queue, b)
+					break
+				}
+			}
+		}
+		b := queue[0]
+		queue = queue[1:]
+		if visited[b] {
+			continue
+		}
+		visited[b] = true
+		for _, s := range succ[b] {
+			if visited[s] {
+				continue
+			}
+			s.layer = max(s.layer, b.layer+1)
+			if indeg[s]--; indeg[s] == 0 {
+				queue = append(queue, s)
+			}
+		}
+	}
+
+	// Place the layers as columns
+	var layers [][]*layoutBox
+	for _, b := range boxes {
+		for len(layers) <= b.layer {
+			layers = append(layers, nil)
+		}
+		layers[b.layer] = append(layers[b.layer], b)
+		for _, l := range b.lines {
+			b.w = max(b.w, len(l)*layoutCharWidth+2*layoutPadding)
+		}
+		b.h = len(b.lines)*layoutLineHeight + 2*layoutPadding
+	}
+	width, height := layoutMargin, 0
+	for _, layer := range layers {
+		columnW, y := 0, layoutMargin
+		for _, b := range layer {
+			columnW = max(columnW, b.w)
+		}
+		for _, b := range layer {
+			b.x, b.y = width, y
+			b.w = columnW
+			y += b.h + layoutRowGap
+		}
+		width += columnW + layoutColumnGap
+		height = max(height, y)
+	}
+	// An empty graph is drawn as an empty canvas
+	width = max(width+layoutMargin-layoutColumnGap, 2*layoutMargin)
+	height = max(height+layoutMargin-layoutRowGap, 2*layoutMargin)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="10">`+"\n", width, height, width, height)
+	out.WriteString(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto"><path d="M0,0L10,5L0,10z"/></marker></defs>` + "\n")
+	fmt.Fprintf(&out, `<rect width="%d" height="%d" fill="white"/>`+"\n", width, height)
+	for _, l := range links {
+		x1, y1 := l.from.x+l.from.w, l.from.y+l.from.h/2
+		x2, y2 := l.to.x, l.to.y+l.to.h/2
+		fmt.Fprintf(&out, `<path d="M%d,%d C%d,%d %d,%d %d,%d" fill="none" stroke="black" marker-end="url(#arrow)"/>`+"\n", x1, y1, (x1+x2)/2, y1, (x1+x2)/2, y2, x2, y2)
+	}
+	for _, b := range boxes {
+		fmt.Fprintf(&out, `<rect x="%d" y="%d" width="%d" height="%d" rx="4" fill="#aaaaff" stroke="black"/>`+"\n", b.x, b.y, b.w, b.h)
+		for i, l := range b.lines {
+			fmt.Fprintf(&out, `<text x="%d" y="%d">%s</text>`+"\n", b.x+layoutPadding, b.y+layoutPadding+(i+1)*layoutLineHeight-2, html.EscapeString(l))
+		}
+	}
+	out.WriteString("</svg>\n")
+	return []byte(out.String()), nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDOT(t *testing.T) {
+	tests := []struct {
+		name string
+		dot  string
+		// label of the visible cluster of each node, "" if it has none
+		nodes map[string]string
+		edges [][2]string
+		err   bool
+	}{
+		{
+			name:  "quoted ids",
+			dot:   `digraph g { "a b" -> "c\"d"; "e;f"; }`,
+			nodes: map[string]string{"e;f": ""},
+			edges: [][2]string{{"a b", `c"d`}},
+		},
+		{
+			name: "subgraphs",
+			dot: `digraph pipeline {
+				subgraph cluster_src {
+					label="GstFakeSrc\nsrc";
+					subgraph cluster_src_pads { label=""; style="invis"; src_src; }
+				}
+				subgraph cluster_sink {
+					label="GstFakeSink\nsink";
+					subgraph cluster_sink_pads { label="pads"; sink_sink; }
+				}
+				src_src -> sink_sink
+			}`,
+			nodes: map[string]string{"src_src": "GstFakeSrc\nsrc", "sink_sink": "pads"},
+			edges: [][2]string{{"src_src", "sink_sink"}},
+		},
+		{
+			name: "attributes",
+			dot: `digraph g {
+				rankdir=LR;
+				node [style="filled,rounded", shape=box, label="x"];
+				edge [labelfontsize=6];
+				subgraph cluster_a { label="A"; a_src [color=black, label="src\n[>][bfb]", height="0.2"]; }
+				a_src -> b_sink [label="ANY"]
+			}`,
+			nodes: map[string]string{"a_src": "A"},
+			edges: [][2]string{{"a_src", "b_sink"}},
+		},
+		{
+			name:  "escapes",
+			dot:   `digraph g { subgraph cluster_a { label="GstQueue\nqueue \"0\"\lx\\y\r"; a_src; } }`,
+			nodes: map[string]string{"a_src": "GstQueue\nqueue \"0\"\nx\\y\n"},
+		},
+		{
+			name:  "legend",
+			dot:   `digraph g { legend [shape=box, label="Legend"]; a; }`,
+			nodes: map[string]string{"a": ""},
+		},
+		{
+			name: "no graph",
+			dot:  "digraph g",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := parseDOT(tt.dot)
+			if tt.err {
+				if err == nil {
+					t.Fatal("parseDOT() succeeded, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDOT() failed: %v", err)
+			}
+			nodes := make(map[string]string)
+			for id, n := range g.nodes {
+				if c := visibleCluster(n.cluster); c != nil {
+					nodes[id] = c.label
+				} else {
+					nodes[id] = ""
+				}
+			}
+			if !reflect.DeepEqual(nodes, tt.nodes) {
+				t.Errorf("nodes = %q, want %q", nodes, tt.nodes)
+			}
+			if !reflect.DeepEqual(g.edges, tt.edges) {
+				t.Errorf("edges = %q, want %q", g.edges, tt.edges)
+			}
+		})
+	}
+}
+
+func TestRenderGraphSVG(t *testing.T) {
+	element := func(name, label string) string {
+		return fmt.Sprintf(`subgraph cluster_%s { label="%s"; subgraph cluster_%s_pads { label=""; style="invis"; %s_src; %s_sink; } }`, name, label, name, name, name)
+	}
+	tests := []struct {
+		name          string
+		dot           string
+		width, height int
+		want          []string
+		notWant       []string
+	}{
+		{
+			name:   "empty",
+			dot:    "digraph g { }",
+			width:  20,
+			height: 20,
+			notWant: []string{
+				`<rect x=`,
+				`marker-end=`,
+			},
+		},
+		{
+			name: "chain",
+			dot: "digraph g {" +
+				element("a", `AA\naa\n[>]`) + element("b", `BB\nbb`) +
+				"a_src -> b_sink; b_src -> b_sink }",
+			width:  128,
+			height: 56,
+			want: []string{
+				`<rect x="10" y="10" width="24" height="36"`,
+				`<rect x="94" y="10" width="24" height="36"`,
+				`<path d="M34,28 C64,28 64,28 94,28"`,
+				`<text x="16" y="26">AA</text>`,
+				`<text x="16" y="38">aa</text>`,
+			},
+			notWant: []string{
+				// Properties and links within a box are not drawn
+				`[&gt;]`,
+				`<path d="M118,28 C`,
+			},
+		},
+		{
+			name: "branches",
+			dot: "digraph g {" +
+				element("a", `A\na`) + element("b", `B\nb`) + element("c", `Cc\nc`) +
+				"a_src -> b_sink; a_src -> c_sink }",
+			width:  122,
+			height: 108,
+			want: []string{
+				`<rect x="10" y="10" width="18" height="36"`,
+				// Boxes of a layer share the width of the widest
+				`<rect x="88" y="10" width="24" height="36"`,
+				`<rect x="88" y="62" width="24" height="36"`,
+			},
+		},
+		{
+			name: "cycle",
+			dot: "digraph g {" +
+				element("a", `A\na`) + element("b", `B\nb`) +
+				"a_src -> b_sink; b_src -> a_sink }",
+			width:  116,
+			height: 56,
+			want: []string{
+				`<rect x="10" y="10" width="18" height="36"`,
+				`<rect x="88" y="10" width="18" height="36"`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := renderGraphSVG(tt.dot)
+			if err != nil {
+				t.Fatalf("renderGraphSVG() failed: %v", err)
+			}
+			svg := string(b)
+			size := fmt.Sprintf(`width="%d" height="%d" viewBox="0 0 %d %d"`, tt.width, tt.height, tt.width, tt.height)
+			if !strings.Contains(svg, size) {
+				t.Errorf("SVG does not have size %dx%d:\n%s", tt.width, tt.height, svg)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(svg, w) {
+					t.Errorf("SVG does not contain %s:\n%s", w, svg)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(svg, w) {
+					t.Errorf("SVG contains %s:\n%s", w, svg)
+				}
+			}
+		})
+	}
+}
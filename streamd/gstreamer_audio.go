@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+// audioInput is an audio source with its channel strip. The splitter feeds
+// every mix the input is part of. The source of an input whose channels are
+// mapped to other inputs is captured with all channels and has no strip, its
+// splitter feeds the channel map bins of those inputs.
+type audioInput struct {
+	config   audioInputConfig
+	src      *gst.Bin
+	strip    *gst.Bin // nil if mapped
+	splitter *gst.Bin
+	// next unlinked src pad of the splitter
+	nextPad int
+}
+
+// audioMix mixes several audio inputs. The splitter feeds every output the
+// mix is routed to.
+type audioMix struct {
+	config   audioMixConfig
+	mixer    *gst.Bin
+	splitter *gst.Bin
+	// next unlinked src pad of the splitter
+	nextPad int
+}
+
+// Link the next src pad of the splitter to sinkPad of sink
+func linkNextSplitterPad(splitter *gst.Bin, next *int, sink *gst.Bin, sinkPad string) error {
+	srcPad := fmt.Sprintf("src_%d", *next)
+	*next++
+	return linkPads(splitter.Element, srcPad, sink.Element, sinkPad)
+}
+
+// The number of channels delivered by the device of a mapped input is fixed,
+// so that they are not downmixed before they are picked
+func newAudioSourceBin(name string, in audioInputConfig, caps audioCapsFilter, params audioParams) (*gst.Bin, error) {
+	switch in.factory {
+	case "audiotestsrc":
+		return newAudioTestSourceBin(name, in.opts, caps, params)
+	case "alsasrc":
+		return newALSASourceBin(name, in.opts, in.channels, caps, params)
+	case "decklinkaudiosrc":
+		opts := in.opts
+		if in.mapped() {
+			opts = fmt.Sprintf("%s channels=%d", opts, in.channels)
+		}
+		return newDecklinkAudioSourceBin(name, opts, caps, params)
+	default:
+		return nil, fmt.Errorf("invalid source element factory name for audio input '%s'", in.name)
+	}
+}
+
+// Returns the number of splitter outputs required by a mix
+func audioMixOutputs(d *daemonConfig, mix string) int {
+	n := 0
+	for _, output := range audioOutputs {
+		for track, m := range d.audioRoutes[output] {
+			if m == mix {
+				n += d.audioOutputBranches(output, track)
+			}
+		}
+	}
+	return n
+}
+
+// Returns the caps at the end of the source bin of an input. Mapped inputs
+// are captured with their unpositioned channels.
+func (p *pipeline) audioInputCaps(in audioInputConfig) audioCapsFilter {
+	if !in.mapped() {
+		return p.audioCaps
+	}
+	caps := p.audioCaps
+	caps.Channels = in.channels
+	caps.Other = "channel-mask=(bitmask)0x0"
+	return caps
+}
+
+// Construct the bins of all audio inputs and mixes
+func (p *pipeline) newAudioBins(d *daemonConfig) error {
+	var err error
+
+	for _, cfg := range d.audioInputs {
+		if d.avSyncTest && cfg.factory == "audiotestsrc" {
+			cfg.opts = audioSyncTestOpts()
+		}
+		in := &audioInput{config: cfg}
+		params := audioParams{
+			Amplification: cfg.amplification,
+			Processing:    cfg.processing,
+		}
+		if cfg.mapFrom != "" {
+			// The mapped input precedes the inputs its channels are mapped to
+			from := p.audioInput(cfg.mapFrom)
+			in.src, err = newAudioChannelMapBin("input_"+cfg.name, cfg, from.config.channels, p.audioCaps, params)
+		} else {
+			in.src, err = newAudioSourceBin("input_"+cfg.name, cfg, p.audioInputCaps(cfg), params)
+		}
+		if err != nil {
+			return err
+		}
+
+		n := 0
+		if cfg.mapped() {
+			for _, c := range d.audioInputs {
+				if c.mapFrom == cfg.name {
+					n++
+				}
+			}
+		} else {
+			in.strip, err = newAudioStripBin("strip_"+cfg.name, p.audioCaps, cfg)
+			if err != nil {
+				return err
+			}
+			for _, mix := range d.audioMixes {
+				for _, name := range mix.inputs {
+					if name == cfg.name {
+						n++
+					}
+				}
+			}
+		}
+		in.splitter, err = newSplitterBin("splitter_input_"+cfg.name, n)
+		if err != nil {
+			return err
+		}
+
+		p.audioInputs = append(p.audioInputs, in)
+	}
+
+	for _, cfg := range d.audioMixes {
+		mix := &audioMix{config: cfg}
+		echoProbe := slices.ContainsFunc(d.audioInputs, func(in audioInputConfig) bool {
+			return in.processing.EchoCancel && in.processing.EchoReferenceMix == cfg.name
+		})
+		mix.mixer, err = newAudioMixerBin("mix_"+cfg.name, len(cfg.inputs), p.audioCaps, echoProbe)
+		if err != nil {
+			return err
+		}
+		mix.splitter, err = newSplitterBin("splitter_mix_"+cfg.name, audioMixOutputs(d, cfg.name))
+		if err != nil {
+			return err
+		}
+
+		p.audioMixes = append(p.audioMixes, mix)
+	}
+
+	return nil
+}
+
+// Returns all audio bins to be added to the pipeline
+func (p *pipeline) audioBins() []*gst.Element {
+	var elements []*gst.Element
+	for _, in := range p.audioInputs {
+		elements = append(elements, in.src.Element, in.splitter.Element)
+		if in.strip != nil {
+			elements = append(elements, in.strip.Element)
+		}
+	}
+	for _, mix := range p.audioMixes {
+		elements = append(elements, mix.mixer.Element, mix.splitter.Element)
+	}
+	return elements
+}
+
+func (p *pipeline) audioInput(name string) *audioInput {
+	for _, in := range p.audioInputs {
+		if in.config.name == name {
+			return in
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) audioMix(name string) *audioMix {
+	for _, mix := range p.audioMixes {
+		if mix.config.name == name {
+			return mix
+		}
+	}
+	return nil
+}
+
+// Link the audio inputs to their mixes and the mixes to the muxers of the
+// main outputs. The multiview is linked by addMultiview.
+func (p *pipeline) linkAudio(d *daemonConfig) error {
+	for _, in := range p.audioInputs {
+		if in.config.mapFrom != "" {
+			from := p.audioInput(in.config.mapFrom)
+			if err := linkNextSplitterPad(from.splitter, &from.nextPad, in.src, "sink"); err != nil {
+				return err
+			}
+		}
+		if in.config.mapped() {
+			if err := in.src.Link(in.splitter.Element); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := in.src.Link(in.strip.Element); err != nil {
+			return err
+		}
+		if err := in.strip.Link(in.splitter.Element); err != nil {
+			return err
+		}
+	}
+
+	for _, mix := range p.audioMixes {
+		for i, name := range mix.config.inputs {
+			in := p.audioInput(name)
+			if err := linkNextSplitterPad(in.splitter, &in.nextPad, mix.mixer, fmt.Sprintf("sink_%d", i)); err != nil {
+				return err
+			}
+		}
+		if err := mix.mixer.Link(mix.splitter.Element); err != nil {
+			return err
+		}
+	}
+
+	return p.linkAudioOutputs(d, []audioOutputLink{
+		{outputCombined, p.muxerCompositor, "audio_sink", true},
+		{outputPresent, p.muxerPresent, "audio_sink", true},
+		{outputCamera, p.muxerCam, "audio_sink", true},
+	})
+}
+
+type audioOutputLink struct {
+	output  string
+	sink    *gst.Bin
+	sinkPad string
+	// whether the sink carries all tracks of the output on the pads
+	// '<sinkPad>_0' to '<sinkPad>_<n-1>'. Otherwise only the first track is
+	// linked to sinkPad.
+	tracks bool
+}
+
+// Link the mixes routed to the outputs to the given sinks
+func (p *pipeline) linkAudioOutputs(d *daemonConfig, links []audioOutputLink) error {
+	for _, link := range links {
+		mixes := d.audioRoutes[link.output]
+		if !link.tracks {
+			mixes = mixes[:1]
+		}
+		for i, name := range mixes {
+			mix := p.audioMix(name)
+			sinkPad := link.sinkPad
+			if link.tracks {
+				sinkPad = fmt.Sprintf("%s_%d", link.sinkPad, i)
+			}
+			if err := linkNextSplitterPad(mix.splitter, &mix.nextPad, link.sink, sinkPad); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Construct the bins of the audio output, add them to the pipeline, and link
+// them to the mix routed to the output
+func (p *pipeline) addAudioOutput(d *daemonConfig) error {
+	var links []audioOutputLink
+
+	if d.audioOutput {
+		var err error
+		p.muxerAudio, err = newAudioMPEGTSMuxerBin("muxer_audio", d.audioEncBitrateKbps, d.audioTracks(outputAudio))
+		if err != nil {
+			return err
+		}
+		p.srtAudioSink, err = newSRTSink("sink_audio", d.srtURI(d.audioPort))
+		if err != nil {
+			return err
+		}
+		if err := p.pipeline.AddMany(p.muxerAudio.Element, p.srtAudioSink.Element); err != nil {
+			return err
+		}
+		if err := p.muxerAudio.Link(p.srtAudioSink.Element); err != nil {
+			return err
+		}
+		links = append(links, audioOutputLink{outputAudio, p.muxerAudio, "audio_sink", true})
+	}
+
+	if d.audioOutputIcecast != nil {
+		var err error
+		p.icecastSink, err = newIcecastSinkBin("sink_icecast", d.audioOutputIcecast, d.audioEncBitrateKbps)
+		if err != nil {
+			return err
+		}
+		if err := p.pipeline.Add(p.icecastSink.Element); err != nil {
+			return err
+		}
+		links = append(links, audioOutputLink{outputAudio, p.icecastSink, "sink", false})
+	}
+
+	return p.linkAudioOutputs(d, links)
+}
+
+// Returns the names of the bins of the audio output
+func (p *pipeline) audioOutputBins() []outputBinNames {
+	var outputs []outputBinNames
+	if p.muxerAudio != nil {
+		outputs = append(outputs, outputBinNames{"audio", []string{p.muxerAudio.GetName(), p.srtAudioSink.GetName()}, p.srtAudioSink})
+	}
+	if p.icecastSink != nil {
+		outputs = append(outputs, outputBinNames{"icecast", []string{p.icecastSink.GetName()}, nil})
+	}
+	return outputs
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-gst/go-gst/gst"
 )
@@ -70,16 +72,23 @@ type audioCapsFilter struct {
 	Channels int
 	Rate     int
 	Format   string
+	Other    string
 }
 
 type audioParams struct {
 	Amplification float64
+	Processing    audioProcessing
 }
 
 // Returns a description of the AudioCapsfilter instance that can be used in a
 // pipeline description.
 func (c *audioCapsFilter) string() string {
-	return fmt.Sprintf("%s,channels=%d,rate=%d,format=%s", c.Mimetype, c.Channels, c.Rate, c.Format)
+	str := fmt.Sprintf("\"%s,channels=%d,rate=%d,format=%s", c.Mimetype, c.Channels, c.Rate, c.Format)
+	if c.Other != "" {
+		str = str + "," + c.Other
+	}
+
+	return str + "\""
 }
 
 // Creates a VideoTestSourceBin with a single sink ghost-pad
@@ -97,12 +106,15 @@ func newVideoTestSourceBin(name string, pattern videoPattern, caps videoCapsFilt
 	return bin, nil
 }
 
-// Creates a V4L2SourceBin with a single sink ghost-pad
-func newV4L2SourceBin(name string, opts string, caps videoCapsFilter) (*gst.Bin, error) {
+// Creates a V4L2SourceBin with a single sink ghost-pad. The device captures
+// deviceCaps, which are scaled, letterboxed, and frame rate converted to caps.
+func newV4L2SourceBin(name string, opts string, deviceCaps string, caps videoCapsFilter) (*gst.Bin, error) {
 	desc := fmt.Sprintf(
-		"v4l2src name=v4l2src_%s %s ! video/x-raw,width=1920,height=1080 ! queue ! videoconvertscale name=videoconvertscale_%s ! capsfilter name=capsfilter_%s caps=%s",
+		"v4l2src name=v4l2src_%s %s ! %s ! queue ! videoconvertscale name=videoconvertscale_%s add-borders=1 ! videorate name=videorate_%s ! capsfilter name=capsfilter_%s caps=%s",
 		name,
 		opts,
+		deviceCaps,
+		name,
 		name,
 		name,
 		caps.string(),
@@ -112,16 +124,23 @@ func newV4L2SourceBin(name string, opts string, caps videoCapsFilter) (*gst.Bin,
 	return bin, err
 }
 
-func newDecklinkVideoSourceBin(name string, opts string, caps videoCapsFilter) (*gst.Bin, error) {
+// Creates a DecklinkVideoSourceBin with a single sink ghost-pad. The video is
+// deinterlaced and its colour space corrected according to settings, and
+// converted to BT.709.
+func newDecklinkVideoSourceBin(name string, opts string, settings videoSourceSettings, caps videoCapsFilter) (*gst.Bin, error) {
 	decklinkvideosrcName := "decklinkvideosrc_" + name
 	videoconvertscaleName := "videoconvertscale_" + name
 	videorateName := "videorate_" + name
 	capsfilterName := "capsfilter_" + name
 
+	// SD modes are BT.601, converting avoids mismatches in the compositor and
+	// the encoders
+	caps.Other = "colorimetry=bt709"
 	desc := fmt.Sprintf(
-		"decklinkvideosrc name=%s %s ! videoconvertscale name=%s ! videorate name=%s ! capsfilter name=%s caps=%s",
+		"decklinkvideosrc name=%s %s ! %svideoconvertscale name=%s ! videorate name=%s ! capsfilter name=%s caps=%s",
 		decklinkvideosrcName,
 		opts,
+		videoSourceProcessingDesc(name, settings),
 		videoconvertscaleName,
 		videorateName,
 		capsfilterName,
@@ -133,15 +152,18 @@ func newDecklinkVideoSourceBin(name string, opts string, caps videoCapsFilter) (
 }
 
 // Creates an AudioTestSourceBin with a single sink ghost-pad
-func newAudioTestSourceBin(name string, caps audioCapsFilter, params audioParams) (*gst.Bin, error) {
-	desc := fmt.Sprintf("audiotestsrc name=audiotestsrc_%s ! capsfilter name=capsfilter_%s caps=%s",
+func newAudioTestSourceBin(name string, opts string, caps audioCapsFilter, params audioParams) (*gst.Bin, error) {
+	desc := fmt.Sprintf("audiotestsrc name=audiotestsrc_%s %s ! capsfilter name=capsfilter_%s caps=%s ! %s%s",
 		name,
+		opts,
 		name,
 		caps.string(),
+		audioProcessingDesc(name, params.Processing, caps),
+		audioLevelDesc(name),
 	)
 
 	// Automatically create ghost-pads for all unlinked pads. In this case this
-	// is the capsfilter sink pad.
+	// is the level src pad.
 	bin, err := gst.NewBinFromString(desc, true)
 	if err != nil {
 		return nil, err
@@ -150,8 +172,13 @@ func newAudioTestSourceBin(name string, caps audioCapsFilter, params audioParams
 	return bin, err
 }
 
-func newALSASourceBin(name string, opts string, caps audioCapsFilter, params audioParams) (*gst.Bin, error) {
+// The device is opened with channels channels, or its default if 0
+func newALSASourceBin(name string, opts string, channels int, caps audioCapsFilter, params audioParams) (*gst.Bin, error) {
 	alsasrcName := "alsasrc_" + name
+	srcCaps := ""
+	if channels > 0 {
+		srcCaps = fmt.Sprintf("capsfilter name=capsfilter_src_%s caps=\"audio/x-raw,channels=%d\" ! ", name, channels)
+	}
 	queue0Name := "queue0_" + name
 	audioconvertName := "audioconvert_" + name
 	audioresampleName := "audioresample_" + name
@@ -161,16 +188,20 @@ func newALSASourceBin(name string, opts string, caps audioCapsFilter, params aud
 
 	// Isolating conversion, resampling, and timestamping to a new thread is necessary.
 	// Leaving out one queue results in clock problems.
-	desc := fmt.Sprintf("alsasrc name=%s %s ! queue name=%s ! audioconvert name=%s ! audioresample name=%s ! audiorate name=%s ! capsfilter name=%s caps=%s ! audioamplify amplification=%f ! queue name=%s",
+	desc := fmt.Sprintf("alsasrc name=%s %s ! %squeue name=%s ! audioconvert name=%s ! audioresample name=%s ! audiorate name=%s ! capsfilter name=%s caps=%s ! audioamplify name=audioamplify_%s amplification=%f ! %s%s ! queue name=%s",
 		alsasrcName,
 		opts,
+		srcCaps,
 		queue0Name,
 		audioconvertName,
 		audioresampleName,
 		audiorateName,
 		capsfilterName,
 		caps.string(),
+		name,
 		params.Amplification,
+		audioProcessingDesc(name, params.Processing, caps),
+		audioLevelDesc(name),
 		queue1Name,
 	)
 	bin, err := gst.NewBinFromString(desc, true)
@@ -189,13 +220,15 @@ func newDecklinkAudioSourceBin(name string, opts string, caps audioCapsFilter, p
 	queue1Name := "queue1_" + name
 
 	desc := fmt.Sprintf(
-		"decklinkaudiosrc name=%s %s ! queue name=%s ! audioconvert name=%s ! audioresample ! capsfilter name=%s caps=%s ! queue name=%s",
+		"decklinkaudiosrc name=%s %s ! queue name=%s ! audioconvert name=%s ! audioresample ! capsfilter name=%s caps=%s ! %s%s ! queue name=%s",
 		decklinkaudiosrcName,
 		opts,
 		queue0Name,
 		audioconvertName,
 		capsfilterName,
 		caps.string(),
+		audioProcessingDesc(name, params.Processing, caps),
+		audioLevelDesc(name),
 		queue1Name,
 	)
 	bin, err := gst.NewBinFromString(desc, true)
@@ -206,6 +239,118 @@ func newDecklinkAudioSourceBin(name string, opts string, caps audioCapsFilter, p
 	return bin, err
 }
 
+// Returns a mix-matrix of audioconvert taking the given channels of an input
+// with inputChannels channels
+func audioMixMatrix(channels []int, inputChannels int) string {
+	rows := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		row := make([]string, inputChannels)
+		for i := range row {
+			row[i] = "(float)0"
+			if i == ch {
+				row[i] = "(float)1"
+			}
+		}
+		rows = append(rows, "<"+strings.Join(row, ", ")+">")
+	}
+	return "<" + strings.Join(rows, ", ") + ">"
+}
+
+// Creates an AudioChannelMapBin taking the mapped channels of an input with
+// inputChannels channels, with a single sink and src ghost-pad. The other
+// channels are discarded.
+func newAudioChannelMapBin(name string, in audioInputConfig, inputChannels int, caps audioCapsFilter, params audioParams) (*gst.Bin, error) {
+	mapCaps := caps
+	mapCaps.Channels = len(in.mapChannels)
+
+	desc := fmt.Sprintf(
+		"audioconvert name=audioconvert_map_%s mix-matrix=\"%s\" ! capsfilter name=capsfilter_map_%s caps=%s ! audioconvert name=audioconvert_%s ! capsfilter name=capsfilter_%s caps=%s ! %s%s",
+		name,
+		audioMixMatrix(in.mapChannels, inputChannels),
+		name,
+		mapCaps.string(),
+		name,
+		name,
+		caps.string(),
+		audioProcessingDesc(name, params.Processing, caps),
+		audioLevelDesc(name),
+	)
+	bin, err := gst.NewBinFromString(desc, true)
+	if err != nil {
+		return nil, err
+	}
+	bin.Element.SetProperty("name", name)
+	return bin, nil
+}
+
+// Creates an AudioStripBin applying the gain, mute, and pan of an audio input
+// with a single sink and src ghost-pad. The output is converted to caps.
+func newAudioStripBin(name string, caps audioCapsFilter, in audioInputConfig) (*gst.Bin, error) {
+	desc := fmt.Sprintf(
+		"volume name=volume_%s volume=%f mute=%t ! audiopanorama name=audiopanorama_%s panorama=%f ! audioconvert name=audioconvert_%s ! capsfilter name=capsfilter_%s caps=%s",
+		name,
+		dbToAmplitude(in.gainDB),
+		in.mute,
+		name,
+		in.pan,
+		name,
+		name,
+		caps.string(),
+	)
+	bin, err := gst.NewBinFromString(desc, true)
+	if err != nil {
+		return nil, err
+	}
+	bin.Element.SetProperty("name", name)
+	return bin, nil
+}
+
+// Creates an AudioMixerBin with n sink ghost-pads named 'sink_0' to
+// 'sink_<n-1>' and a single src ghost-pad. With echoProbe, the output is fed
+// to a webrtcechoprobe as far-end reference for echo cancellation.
+func newAudioMixerBin(name string, n int, caps audioCapsFilter, echoProbe bool) (*gst.Bin, error) {
+	audiomixerName := "audiomixer_" + name
+	capsfilterName := "capsfilter_" + name
+	srcName := capsfilterName
+
+	// Each input is decoupled by a queue, as an input may feed several mixers
+	desc := fmt.Sprintf(
+		"audiomixer name=%s ! audioconvert name=audioconvert_%s ! capsfilter name=%s caps=%s",
+		audiomixerName,
+		name,
+		capsfilterName,
+		caps.string(),
+	)
+	if echoProbe {
+		srcName = echoProbeName(name)
+		desc += fmt.Sprintf(" ! webrtcechoprobe name=%s", srcName)
+	}
+	descs := []string{desc}
+	for i := 0; i < n; i++ {
+		descs = append(descs, fmt.Sprintf("queue name=queue_%s_%d ! %s.sink_%d", name, i, audiomixerName, i))
+	}
+
+	// Do not automatically create ghost-pads, as the sink pads are named
+	bin, err := gst.NewBinFromString(strings.Join(descs, " "), false)
+	if err != nil {
+		return nil, err
+	}
+	bin.Element.SetProperty("name", name)
+
+	for i := 0; i < n; i++ {
+		err = createGhostPad(fmt.Sprintf("queue_%s_%d", name, i), "sink", fmt.Sprintf("sink_%d", i), bin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = createGhostPad(srcName, "src", "src", bin)
+	if err != nil {
+		return nil, err
+	}
+
+	return bin, nil
+}
+
 type combinedViewConfig struct {
 	OutputCaps       videoCapsFilter
 	CameraCaps       videoCapsFilter
@@ -249,6 +394,24 @@ func createGhostPadWithPad(pad *gst.Pad, ghostPad string, bin *gst.Bin) error {
 	return nil
 }
 
+// Link the static pad srcPad of src to the static pad sinkPad of sink
+func linkPads(src *gst.Element, srcPad string, sink *gst.Element, sinkPad string) error {
+	srcP := src.GetStaticPad(srcPad)
+	if srcP == nil {
+		return fmt.Errorf("failed to get static pad '%s' from '%s' element", srcPad, src.GetName())
+	}
+	sinkP := sink.GetStaticPad(sinkPad)
+	if sinkP == nil {
+		return fmt.Errorf("failed to get static pad '%s' from '%s' element", sinkPad, sink.GetName())
+	}
+
+	if ret := srcP.Link(sinkP); ret != gst.PadLinkOK {
+		return fmt.Errorf("failed to link '%s:%s' to '%s:%s': %s", src.GetName(), srcPad, sink.GetName(), sinkPad, ret)
+	}
+
+	return nil
+}
+
 func newCompositorBin(name string, config combinedViewConfig) (*gst.Bin, error) {
 	sink1_xpos := config.OutputCaps.Width - config.CameraCaps.Width
 
@@ -269,6 +432,9 @@ func newCompositorBin(name string, config combinedViewConfig) (*gst.Bin, error)
 	capsfilterName := "capsfilter_" + name
 	queueSink0Name := "queue_sink_0_" + name
 	queueSink1Name := "queue_sink_1_" + name
+	// Sources may run at a different frame rate than the output
+	videorateSink0Name := "videorate_sink_0_" + name
+	videorateSink1Name := "videorate_sink_1_" + name
 	capsfilterSink0Name := "capsfilter_sink_0_" + name
 	capsfilterSink1Name := "capsfilter_sink_1_" + name
 	capsfilterSink2Name := "capsfilter_sink_2_" + name
@@ -283,8 +449,9 @@ func newCompositorBin(name string, config combinedViewConfig) (*gst.Bin, error)
 		config.OutputCaps.string(),
 	)
 	sink0_desc := fmt.Sprintf(
-		"queue name=%s ! %s name=%s add-borders=1 ! capsfilter name=%s caps=%s ! %s.sink_0",
+		"queue name=%s ! videorate name=%s ! %s name=%s add-borders=1 ! capsfilter name=%s caps=%s ! %s.sink_0",
 		queueSink0Name,
+		videorateSink0Name,
 		scaler,
 		scalerSink0Name,
 		capsfilterSink0Name,
@@ -292,8 +459,9 @@ func newCompositorBin(name string, config combinedViewConfig) (*gst.Bin, error)
 		compName,
 	)
 	sink1_desc := fmt.Sprintf(
-		"queue name=%s ! %s name=%s add-borders=1 ! capsfilter name=%s caps=%s ! %s.sink_1",
+		"queue name=%s ! videorate name=%s ! %s name=%s add-borders=1 ! capsfilter name=%s caps=%s ! %s.sink_1",
 		queueSink1Name,
+		videorateSink1Name,
 		scaler,
 		scalerSink1Name,
 		capsfilterSink1Name,
@@ -332,7 +500,9 @@ func newCompositorBin(name string, config combinedViewConfig) (*gst.Bin, error)
 	return bin, err
 }
 
-func new1x2SplitterBin(name string) (*gst.Bin, error) {
+// Creates a splitter bin with a single sink ghost-pad and n src ghost-pads
+// named 'src_0' to 'src_<n-1>'.
+func newSplitterBin(name string, n int) (*gst.Bin, error) {
 	bin := gst.NewBin(name)
 	if bin == nil {
 		return nil, fmt.Errorf("cannot create bin '%s'", name)
@@ -348,65 +518,131 @@ func new1x2SplitterBin(name string) (*gst.Bin, error) {
 		return nil, err
 	}
 
-	src0 := tee.GetRequestPad("src_0")
-	src1 := tee.GetRequestPad("src_1")
-	if src0 == nil || src1 == nil {
-		return nil, fmt.Errorf("failed to request 'src_0' or 'src_1' pad from '%s'", teeName)
-	}
-
 	err = createGhostPadWithElement(tee, "sink", "sink", bin)
 	if err != nil {
 		return nil, err
 	}
-	err = createGhostPadWithPad(src0, "src_0", bin)
-	if err != nil {
-		return nil, err
-	}
-	err = createGhostPadWithPad(src1, "src_1", bin)
-	if err != nil {
-		return nil, err
+
+	for i := 0; i < n; i++ {
+		padName := fmt.Sprintf("src_%d", i)
+		src := tee.GetRequestPad(padName)
+		if src == nil {
+			return nil, fmt.Errorf("failed to request '%s' pad from '%s'", padName, teeName)
+		}
+
+		err = createGhostPadWithPad(src, padName, bin)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return bin, nil
 }
 
-// TODO(hugo): make splitter constructor generic or argument based
-func new1x3SplitterBin(name string) (*gst.Bin, error) {
-	bin := gst.NewBin(name)
-	if bin == nil {
-		return nil, fmt.Errorf("cannot create bin '%s'", name)
+// Returns the description of the encoding branch of an audio track, tagged
+// with its title and language. The branch starts with the queue
+// 'queue_audio_<name>_<i>'.
+func audioTrackDesc(name string, i int, track audioTrack, aacBitrate int) string {
+	tags := "title=" + track.title
+	if track.language != "" {
+		tags += ",language-code=" + track.language
+	}
+	return fmt.Sprintf(
+		"queue name=queue_audio_%s_%d ! taginject name=taginject_%s_%d tags=\"%s\" ! fdkaacenc name=fdkaacenc_%s_%d bitrate=%d rate-control=vbr",
+		name, i,
+		name, i,
+		tags,
+		name, i,
+		aacBitrate*1000,
+	)
+}
+
+// Creates a MuxerBin encoding video and audio with the sink ghost-pads
+// 'video_sink' and 'audio_sink_0' to 'audio_sink_<n-1>', one for every
+// track, and a single src ghost-pad. If caps is not nil, the video is
+// scaled and its frame rate converted to caps before encoding.
+func newMPEGTSMuxerBin(name string, h264Bitrate int, aacBitrate int, hwAccel bool, tracks []audioTrack, caps *videoCapsFilter) (*gst.Bin, error) {
+	videoQueueName := "queue_video_" + name
+	h264EncName := "h264enc_" + name
+	muxName := "mpegtsmux_" + name
+	muxDesc := "matroskamux name=" + muxName
+
+	h264enc := "x264enc name=" + h264EncName + " tune=zerolatency pass=17" // pass=17 is vbr encoding pass1
+	if hwAccel {
+		h264enc = "vah264enc name=" + h264EncName + " rate-control=vbr"
 	}
 
-	teeName := "tee_" + name
-	tee, err := gst.NewElementWithName("tee", teeName)
-	if err != nil {
-		return nil, err
+	descs := []string{muxDesc}
+	for i, track := range tracks {
+		descs = append(descs, audioTrackDesc(name, i, track, aacBitrate)+" ! "+muxName+".")
+	}
+	conversion := ""
+	if caps != nil {
+		conversion = fmt.Sprintf(
+			"videoconvertscale name=videoconvertscale_%s add-borders=1 ! videorate name=videorate_%s ! capsfilter name=capsfilter_%s caps=%s ! ",
+			name,
+			name,
+			name,
+			caps.string(),
+		)
 	}
+	videoQueueDesc := fmt.Sprintf(
+		"queue name=%s ! %s%s bitrate=%d ! video/x-h264,pixel-aspect-ratio=1/1,format=high ! h264parse config-interval=-1 ! %s.",
+		videoQueueName,
+		conversion,
+		h264enc,
+		h264Bitrate,
+		muxName,
+	)
 
-	if err = bin.Add(tee); err != nil {
+	descs = append(descs, videoQueueDesc)
+	bin, err := gst.NewBinFromString(strings.Join(descs, " "), false)
+	if err != nil {
 		return nil, err
 	}
+	bin.Element.SetProperty("name", name)
 
-	src0 := tee.GetRequestPad("src_0")
-	src1 := tee.GetRequestPad("src_1")
-	src2 := tee.GetRequestPad("src_2")
-	if src0 == nil || src1 == nil || src2 == nil {
-		return nil, fmt.Errorf("failed to request 'src_0', 'src_1', 'src_2' pad from '%s'", teeName)
+	for i := range tracks {
+		err = createGhostPad(fmt.Sprintf("queue_audio_%s_%d", name, i), "sink", fmt.Sprintf("audio_sink_%d", i), bin)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	err = createGhostPadWithElement(tee, "sink", "sink", bin)
+	err = createGhostPad(videoQueueName, "sink", "video_sink", bin)
 	if err != nil {
 		return nil, err
 	}
-	err = createGhostPadWithPad(src0, "src_0", bin)
+	err = createGhostPad(muxName, "src", "src", bin)
 	if err != nil {
 		return nil, err
 	}
-	err = createGhostPadWithPad(src1, "src_1", bin)
+
+	return bin, err
+}
+
+// Creates an AudioMPEGTSMuxerBin encoding audio to AAC in MPEG-TS with the
+// sink ghost-pads 'audio_sink_0' to 'audio_sink_<n-1>', one for every track,
+// and a single src ghost-pad
+func newAudioMPEGTSMuxerBin(name string, aacBitrate int, tracks []audioTrack) (*gst.Bin, error) {
+	muxName := "mpegtsmux_" + name
+
+	descs := []string{"mpegtsmux name=" + muxName}
+	for i, track := range tracks {
+		descs = append(descs, audioTrackDesc(name, i, track, aacBitrate)+fmt.Sprintf(" ! aacparse name=aacparse_%s_%d ! %s.", name, i, muxName))
+	}
+	bin, err := gst.NewBinFromString(strings.Join(descs, " "), false)
 	if err != nil {
 		return nil, err
 	}
-	err = createGhostPadWithPad(src2, "src_2", bin)
+	bin.Element.SetProperty("name", name)
+
+	for i := range tracks {
+		err = createGhostPad(fmt.Sprintf("queue_audio_%s_%d", name, i), "sink", fmt.Sprintf("audio_sink_%d", i), bin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = createGhostPad(muxName, "src", "src", bin)
 	if err != nil {
 		return nil, err
 	}
@@ -414,53 +650,110 @@ func new1x3SplitterBin(name string) (*gst.Bin, error) {
 	return bin, nil
 }
 
-func newMPEGTSMuxerBin(name string, h264Bitrate int, aacBitrate int, hwAccel bool) (*gst.Bin, error) {
-	audioQueueName := "queue_audio_" + name
-	videoQueueName := "queue_video_" + name
-	aacEncName := "fdkaacenc_" + name
-	muxName := "mpegtsmux_" + name
-	muxDesc := "matroskamux name=" + muxName
-
-	h264enc := "x264enc tune=zerolatency pass=17" // pass=17 is vbr encoding pass1
-	if hwAccel {
-		h264enc = "vah264enc rate-control=vbr"
+// Creates an IcecastSinkBin encoding audio for and streaming it to an Icecast
+// mount, with a single sink ghost-pad
+func newIcecastSinkBin(name string, c *icecastConfig, bitrate int) (*gst.Bin, error) {
+	enc := fmt.Sprintf("opusenc name=opusenc_%s bitrate=%d ! oggmux name=oggmux_%s", name, bitrate*1000, name)
+	if c.format == icecastFormatMP3 {
+		enc = fmt.Sprintf("lamemp3enc name=lamemp3enc_%s target=bitrate bitrate=%d cbr=true", name, bitrate)
 	}
 
-	audioQueueDesc := fmt.Sprintf(
-		"queue name=%s ! fdkaacenc name=%s bitrate=%d rate-control=vbr ! %s.",
-		audioQueueName,
-		aacEncName,
-		aacBitrate*1000,
-		muxName,
+	shout2sendName := "shout2send_" + name
+	desc := fmt.Sprintf(
+		"queue name=queue_%s ! audioconvert name=audioconvert_%s ! audioresample name=audioresample_%s ! %s ! shout2send name=%s",
+		name,
+		name,
+		name,
+		enc,
+		shout2sendName,
 	)
-	videoQueueDesc := fmt.Sprintf(
-		"queue name=%s ! %s bitrate=%d ! video/x-h264,pixel-aspect-ratio=1/1,format=high ! h264parse config-interval=-1 ! %s.",
+	bin, err := gst.NewBinFromString(desc, true)
+	if err != nil {
+		return nil, err
+	}
+	bin.Element.SetProperty("name", name)
+
+	// The mount and credentials are set as properties, as they may contain
+	// characters with a meaning in pipeline descriptions
+	shout2send, err := bin.GetElementByName(shout2sendName)
+	if err != nil {
+		return nil, err
+	}
+	props := []struct {
+		name  string
+		value any
+	}{
+		{"ip", c.host},
+		{"port", c.port},
+		{"mount", c.mount},
+		{"username", c.username},
+		{"password", c.password},
+	}
+	for _, prop := range props {
+		if err := shout2send.SetProperty(prop.name, prop.value); err != nil {
+			return nil, err
+		}
+	}
+	return bin, nil
+}
+
+// Creates an HLSSinkBin encoding video and audio into HLS segments and a
+// playlist in dir, with the sink ghost-pads 'video_sink' and 'audio_sink'.
+// Segments are cut at keyframes every keyframeInterval frames.
+func newHLSSinkBin(name string, dir string, h264Bitrate int, aacBitrate int, keyframeInterval int) (*gst.Bin, error) {
+	hlssinkName := "hlssink2_" + name
+	videoQueueName := "queue_video_" + name
+	audioQueueName := "queue_audio_" + name
+
+	desc := fmt.Sprintf(
+		"hlssink2 name=%s target-duration=%d playlist-length=5 max-files=10 "+
+			"queue name=%s ! x264enc name=h264enc_%s tune=zerolatency bitrate=%d key-int-max=%d ! h264parse name=h264parse_%s ! %s.video "+
+			"queue name=%s ! audioconvert name=audioconvert_%s ! audioresample name=audioresample_%s ! fdkaacenc name=aacenc_%s bitrate=%d ! aacparse name=aacparse_%s ! %s.audio",
+		hlssinkName,
+		hlsTargetDuration,
 		videoQueueName,
-		h264enc,
+		name,
 		h264Bitrate,
-		muxName,
+		keyframeInterval,
+		name,
+		hlssinkName,
+		audioQueueName,
+		name,
+		name,
+		name,
+		aacBitrate*1000,
+		name,
+		hlssinkName,
 	)
-
-	bin, err := gst.NewBinFromString(muxDesc+" "+audioQueueDesc+" "+videoQueueDesc, false)
+	bin, err := gst.NewBinFromString(desc, false)
 	if err != nil {
 		return nil, err
 	}
 	bin.Element.SetProperty("name", name)
 
-	err = createGhostPad(audioQueueName, "sink", "audio_sink", bin)
+	// Paths are set as properties, as they may contain characters with a
+	// meaning in pipeline descriptions
+	hlssink, err := bin.GetElementByName(hlssinkName)
 	if err != nil {
 		return nil, err
 	}
+	if err := hlssink.SetProperty("location", filepath.Join(dir, "segment%05d.ts")); err != nil {
+		return nil, err
+	}
+	if err := hlssink.SetProperty("playlist-location", filepath.Join(dir, hlsPlaylist)); err != nil {
+		return nil, err
+	}
+
 	err = createGhostPad(videoQueueName, "sink", "video_sink", bin)
 	if err != nil {
 		return nil, err
 	}
-	err = createGhostPad(muxName, "src", "src", bin)
+	err = createGhostPad(audioQueueName, "sink", "audio_sink", bin)
 	if err != nil {
 		return nil, err
 	}
 
-	return bin, err
+	return bin, nil
 }
 
 func newSRTSink(name string, address string) (*gst.Bin, error) {
@@ -474,3 +767,158 @@ func newSRTSink(name string, address string) (*gst.Bin, error) {
 
 	return bin, nil
 }
+
+// Creates a SnapshotBin with a single sink ghost-pad. A closed valve drops
+// all frames until a snapshot is requested, and at most one frame per second
+// is encoded as JPEG into an appsink, so the branch costs almost nothing when
+// unused.
+func newSnapshotBin(name string, hwAccel bool) (*gst.Bin, error) {
+	valveName := "valve_" + name
+	queueName := "queue_" + name
+	videorateName := "videorate_" + name
+	jpegencName := "jpegenc_" + name
+	appsinkName := "appsink_" + name
+
+	// Frames may reside in VRAM (e.g. the output of the vacompositor)
+	download := ""
+	if hwAccel {
+		download = fmt.Sprintf("vapostproc name=vapostproc_%s ! video/x-raw ! ", name)
+	}
+
+	desc := fmt.Sprintf(
+		"valve name=%s drop=true ! queue name=%s leaky=downstream max-size-buffers=1 ! videorate name=%s drop-only=true max-rate=1 ! %svideoconvertscale name=videoconvertscale_%s ! jpegenc name=%s ! appsink name=%s max-buffers=1 drop=true sync=false async=false",
+		valveName,
+		queueName,
+		videorateName,
+		download,
+		name,
+		jpegencName,
+		appsinkName,
+	)
+
+	// Automatically create ghost-pads for all unlinked pads. In this case this
+	// is the valve sink pad.
+	bin, err := gst.NewBinFromString(desc, true)
+	if err != nil {
+		return nil, err
+	}
+	bin.Element.SetProperty("name", name)
+
+	return bin, nil
+}
+
+type multiviewConfig struct {
+	// Caps of a single tile. The output is a 2x2 grid of tiles.
+	TileCaps videoCapsFilter
+	// Whether frames of the combined input reside in VRAM
+	HwAccel bool
+}
+
+// Returns the name of the textoverlay rendering the audio meters of a
+// MultiviewBin
+func multiviewMetersName(name string) string {
+	return "textoverlay_meters_" + name
+}
+
+// Creates a MultiviewBin compositing the combined, presentation, and camera
+// stream together with audio meters into a labeled 2x2 grid with a clock.
+//
+// The bin has the sink ghost-pads 'combined_sink', 'present_sink', and
+// 'camera_sink'. All inputs are leaky, so a slow multiview never stalls the
+// main outputs.
+func newMultiviewBin(name string, config multiviewConfig) (*gst.Bin, error) {
+	compName := "compositor_" + name
+	capsfilterName := "capsfilter_" + name
+	clockoverlayName := "clockoverlay_" + name
+	tileW := config.TileCaps.Width
+	tileH := config.TileCaps.Height
+
+	outputCaps := config.TileCaps
+	outputCaps.Width = 2 * tileW
+	outputCaps.Height = 2 * tileH
+
+	comp_desc := fmt.Sprintf(
+		"compositor name=%s background=black sink_1::xpos=%d sink_2::ypos=%d sink_3::xpos=%d sink_3::ypos=%d sink_4::zorder=0 ! capsfilter name=%s caps=%s ! clockoverlay name=%s time-format=\"%%H:%%M:%%S\" halignment=right valignment=bottom shaded-background=true",
+		compName,
+		tileW,
+		tileH,
+		tileW,
+		tileH,
+		capsfilterName,
+		outputCaps.string(),
+		clockoverlayName,
+	)
+
+	videoTiles := []struct {
+		input string
+		label string
+		// Download frames from VRAM before software scaling
+		download bool
+	}{
+		{"combined", "Combined", config.HwAccel},
+		{"present", "Presentation", false},
+		{"camera", "Camera", false},
+	}
+
+	descs := []string{comp_desc}
+	for idx, tile := range videoTiles {
+		download := ""
+		if tile.download {
+			download = fmt.Sprintf("vapostproc name=vapostproc_%s_%s ! video/x-raw ! ", tile.input, name)
+		}
+
+		descs = append(descs, fmt.Sprintf(
+			"queue name=queue_%s_%s leaky=downstream max-size-buffers=2 ! %svideorate name=videorate_%s_%s drop-only=true ! videoconvertscale name=videoconvertscale_%s_%s add-borders=1 ! capsfilter name=capsfilter_%s_%s caps=%s ! textoverlay name=textoverlay_%s_%s text=\"%s\" valignment=top halignment=left shaded-background=true ! %s.sink_%d",
+			tile.input, name,
+			download,
+			tile.input, name,
+			tile.input, name,
+			tile.input, name,
+			config.TileCaps.string(),
+			tile.input, name,
+			tile.label,
+			compName,
+			idx,
+		))
+	}
+
+	// The text of the meters is updated from the level messages of the audio
+	// inputs
+	meters_desc := fmt.Sprintf(
+		"videotestsrc name=videotestsrc_meters_%s pattern=black is-live=true ! capsfilter name=capsfilter_meters_%s caps=%s ! textoverlay name=%s text=\"Audio\" font-desc=\"Monospace 9\" valignment=top halignment=left ! %s.sink_3",
+		name,
+		name,
+		config.TileCaps.string(),
+		multiviewMetersName(name),
+		compName,
+	)
+	background_desc := fmt.Sprintf(
+		"videotestsrc name=videotestsrc_background_%s pattern=black ! capsfilter name=capsfilter_background_%s caps=\"video/x-raw,width=%d,height=%d\" ! %s.sink_4",
+		name,
+		name,
+		outputCaps.Width,
+		outputCaps.Height,
+		compName,
+	)
+	descs = append(descs, meters_desc, background_desc)
+
+	// Do not automatically create Ghostpads, as sink ghost-pads are not configured correctly.
+	bin, err := gst.NewBinFromString(strings.Join(descs, " "), false)
+	if err != nil {
+		return nil, err
+	}
+	bin.Element.SetProperty("name", name)
+
+	for _, tile := range videoTiles {
+		err = createGhostPad(fmt.Sprintf("queue_%s_%s", tile.input, name), "sink", tile.input+"_sink", bin)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = createGhostPad(clockoverlayName, "src", "src", bin)
+	if err != nil {
+		return nil, err
+	}
+
+	return bin, nil
+}
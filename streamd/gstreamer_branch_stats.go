@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+// branchStats counts the frames passing the src pad of a source, the
+// compositor, or an encoder. The counters are updated from the streaming
+// thread.
+type branchStats struct {
+	// name of the bin the branch belongs to
+	name string
+	// whether the pad carries encoded video with keyframes
+	encoded bool
+	// videorate element of the branch, nil if there is none
+	videorate *gst.Element
+
+	frames    atomic.Uint64
+	bytes     atomic.Uint64
+	keyframes atomic.Uint64
+	// number of frames between the two most recent keyframes
+	keyframeInterval atomic.Uint64
+	// only accessed from the streaming thread
+	sinceKeyframe uint64
+}
+
+// branchSample is a copy of the counters of a branch at a point in time
+type branchSample struct {
+	name    string
+	encoded bool
+	time    time.Time
+
+	frames           uint64
+	bytes            uint64
+	keyframes        uint64
+	keyframeInterval uint64
+
+	// frames dropped and duplicated by videorate, only set if hasVideorate
+	hasVideorate bool
+	dropped      uint64
+	duplicated   uint64
+
+	// rates since the previous sample
+	fps         float64
+	bitrateKbps float64
+}
+
+// Count the frames leaving pad. If encoded is set, the keyframe interval is
+// tracked as well.
+func newBranchStats(name string, pad *gst.Pad, encoded bool) *branchStats {
+	b := &branchStats{name: name, encoded: encoded}
+	pad.AddProbe(gst.PadProbeTypeBuffer, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		buf := info.GetBuffer()
+		if buf == nil {
+			return gst.PadProbeOK
+		}
+		b.frames.Add(1)
+		b.bytes.Add(uint64(buf.GetSize()))
+
+		if encoded {
+			b.sinceKeyframe++
+			if !buf.HasFlags(gst.BufferFlagDeltaUnit) {
+				b.keyframes.Add(1)
+				b.keyframeInterval.Store(b.sinceKeyframe)
+				b.sinceKeyframe = 0
+			}
+		}
+		return gst.PadProbeOK
+	})
+	return b
+}
+
+// Count the frames leaving the src pad of a bin. The videorate element of the
+// bin, if any, is queried for dropped and duplicated frames.
+func newBinBranchStats(bin *gst.Bin) (*branchStats, error) {
+	pad := bin.GetStaticPad("src")
+	if pad == nil {
+		return nil, fmt.Errorf("failed to get static pad 'src' from '%s' bin", bin.GetName())
+	}
+	b := newBranchStats(bin.GetName(), pad, false)
+	if videorate, err := bin.GetElementByName("videorate_" + bin.GetName()); err == nil {
+		b.videorate = videorate
+	}
+	return b, nil
+}
+
+// Count the frames leaving the H.264 encoder of a muxer bin
+func newEncoderBranchStats(muxer *gst.Bin) (*branchStats, error) {
+	enc, err := muxer.GetElementByName("h264enc_" + muxer.GetName())
+	if err != nil {
+		return nil, err
+	}
+	pad := enc.GetStaticPad("src")
+	if pad == nil {
+		return nil, fmt.Errorf("failed to get static pad 'src' from '%s'", enc.GetName())
+	}
+	return newBranchStats(muxer.GetName(), pad, true), nil
+}
+
+// Take a sample of the counters. Rates are computed relative to prev, which
+// may be nil.
+func (b *branchStats) sample(prev *branchSample) (branchSample, error) {
+	s := branchSample{
+		name:             b.name,
+		encoded:          b.encoded,
+		time:             time.Now(),
+		frames:           b.frames.Load(),
+		bytes:            b.bytes.Load(),
+		keyframes:        b.keyframes.Load(),
+		keyframeInterval: b.keyframeInterval.Load(),
+	}
+
+	if b.videorate != nil {
+		s.hasVideorate = true
+		for _, prop := range []struct {
+			dest *uint64
+			name string
+		}{{&s.dropped, "drop"}, {&s.duplicated, "duplicate"}} {
+			v, err := b.videorate.GetProperty(prop.name)
+			if err != nil {
+				return s, err
+			}
+			n, ok := v.(uint64)
+			if !ok {
+				return s, fmt.Errorf("videorate '%s' property is not 'uint64'", prop.name)
+			}
+			*prop.dest = n
+		}
+	}
+
+	if prev != nil {
+		if dt := s.time.Sub(prev.time).Seconds(); dt > 0 {
+			s.fps = float64(s.frames-prev.frames) / dt
+			s.bitrateKbps = float64(s.bytes-prev.bytes) * 8 / 1000 / dt
+		}
+	}
+
+	return s, nil
+}
@@ -8,14 +8,21 @@ import (
 )
 
 type pipelineStats struct {
-	warnings   uint64
-	qosEvents  map[string]uint64 // key is the name of the element
-	minLatency time.Duration
+	state             gst.State // current state of the top-level pipeline
+	warnings          uint64
+	qosEvents         map[string]uint64 // key is the name of the element
+	minLatency        time.Duration
+	maxLatency        time.Duration // -1 if unbounded
+	configuredLatency time.Duration // 0 if unset
+
+	// time of the last warning, key is the name of the element
+	lastWarnings map[string]time.Time
 }
 
 func newPipelineStats() pipelineStats {
 	return pipelineStats{
-		qosEvents: make(map[string]uint64),
+		lastWarnings: make(map[string]time.Time),
+		qosEvents:    make(map[string]uint64),
 	}
 }
 
@@ -25,14 +32,22 @@ func (d *daemon) registerBusWatch() bool {
 	return p.GetBus().AddWatch(func(msg *gst.Message) bool {
 		switch msg.Type() {
 		case gst.MessageEOS: // When end-of-stream is received stop the main loop
-			p.BlockSetState(gst.StateNull)
+			// The pipeline is set to NULL after the main loop has quit
+			d.mu.Lock()
+			d.eosReceived = true
+			d.mu.Unlock()
 			d.mainloop.Quit()
 		case gst.MessageError: // Error messages are always fatal
 			err := msg.ParseError()
+			// Keep the filter graph for the post-mortem
+			d.graphs.record(p.Bin, "error")
 			klog.Fatalf("received an error message on pipeline bus: %v", err)
 		case gst.MessageWarning:
+			klog.Warningf("received a warning message on pipeline bus from '%s': %v", msg.Source(), msg.ParseWarning())
+
 			d.mu.Lock()
 			d.metrics.pipelineStats.warnings += 1
+			d.metrics.pipelineStats.lastWarnings[msg.Source()] = time.Now()
 			d.mu.Unlock()
 		// When buffers arrive late in the sink, i.e. when their running-time is
 		// smaller than that of the clock, we have a QoS problem
@@ -47,6 +62,43 @@ func (d *daemon) registerBusWatch() bool {
 			d.mu.Unlock()
 
 			klog.Warning(msg)
+		case gst.MessageElement:
+			// Level messages are posted every 100ms and not logged
+			s := msg.GetStructure()
+			switch {
+			case s != nil && s.Name() == "level":
+				d.handleLevelMessage(msg.Source(), s)
+			case s != nil && s.Name() == "ebur128-level":
+				d.handleLoudnessMessage(msg.Source(), s)
+			case s != nil && s.Name() == "voice-activity":
+				d.handleVoiceActivityMessage(msg.Source(), s)
+			default:
+				klog.Info(msg)
+			}
+		// Posted when the latency of an element changed. The application is
+		// responsible for redistributing the latency.
+		case gst.MessageLatency:
+			if !p.RecalculateLatency() {
+				klog.Warningf("failed to recalculate latency after latency message from '%s'", msg.Source())
+			}
+			d.updateLatency()
+		case gst.MessageStateChanged:
+			// Only track the state of the top-level pipeline
+			if msg.Source() == p.GetName() {
+				oldState, newState := msg.ParseStateChanged()
+
+				d.mu.Lock()
+				d.metrics.pipelineStats.state = newState
+				d.mu.Unlock()
+
+				d.graphs.record(p.Bin, oldState.String()+"_"+newState.String())
+
+				if newState == gst.StatePlaying {
+					d.updateLatency()
+					d.notifyReady()
+				}
+			}
+			klog.Info(msg)
 		default:
 			// All messages implement a Stringer. However, this is
 			// typically an expensive thing to do and should be avoided.
@@ -55,3 +107,30 @@ func (d *daemon) registerBusWatch() bool {
 		return true
 	})
 }
+
+// Query the latency of the pipeline and record it in the pipeline stats
+func (d *daemon) updateLatency() {
+	p := d.pipeline.pipeline
+
+	q := gst.NewLatencyQuery()
+	if !p.Query(q) {
+		klog.Warning("latency query on pipeline failed")
+		return
+	}
+	_, minLatency, maxLatency := q.ParseLatency()
+
+	var configured time.Duration
+	if c := pipelineGetConfiguredLatency(p).AsDuration(); c != nil {
+		configured = *c
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := &d.metrics.pipelineStats
+	stats.minLatency = time.Duration(minLatency)
+	stats.maxLatency = -1
+	if l := maxLatency.AsDuration(); l != nil {
+		stats.maxLatency = *l
+	}
+	stats.configuredLatency = configured
+}
@@ -3,14 +3,13 @@ package main
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/go-gst/go-gst/gst"
 )
 
-var hz30 = rational{30, 1}
-var caps1920x1080p30 = videoCapsFilter{Mimetype: "video/x-raw", Width: 1920, Height: 1080, Framerate: hz30}
-var caps1440x810p30 = videoCapsFilter{Mimetype: "video/x-raw", Width: 1440, Height: 810, Framerate: hz30}
-var caps480x270p30 = videoCapsFilter{Mimetype: "video/x-raw", Width: 480, Height: 270, Framerate: hz30}
+var caps480x270p15 = videoCapsFilter{Mimetype: "video/x-raw", Width: 480, Height: 270, Framerate: rational{15, 1}}
 
 var capsStereo48Khz = audioCapsFilter{Mimetype: "audio/x-raw", Channels: 2, Rate: 48000, Format: "S16LE"}
 
@@ -21,13 +20,16 @@ type pipeline struct {
 
 	camSrc     *gst.Bin
 	presentSrc *gst.Bin
-	audioSrc   *gst.Bin
 
-	// a 1x2 splitter for splitting the presentation stream into two streams.
-	// One that is muxed directly, the other is fed into the compositor.
+	// splitters of the presentation and camera streams. Each feeds the
+	// compositor, the muxer of its own output, its snapshot branch, and with
+	// -multiview the multiview.
 	splitterPresent *gst.Bin
 	splitterCam     *gst.Bin
-	splitterAudio   *gst.Bin
+
+	// audio inputs and the mixes routed to the outputs
+	audioInputs []*audioInput
+	audioMixes  []*audioMix
 
 	muxerPresent   *gst.Bin
 	srtPresentSink *gst.Bin
@@ -35,9 +37,51 @@ type pipeline struct {
 	muxerCam   *gst.Bin
 	srtCamSink *gst.Bin
 
-	compositor        *gst.Bin
-	muxerCompositor   *gst.Bin
-	srtCompositorSink *gst.Bin
+	compositor         *gst.Bin
+	splitterCompositor *gst.Bin
+	muxerCompositor    *gst.Bin
+	srtCompositorSink  *gst.Bin
+
+	// low-rate JPEG branches for snapshots of the sources and the compositor output
+	snapshotPresent    *gst.Bin
+	snapshotCam        *gst.Bin
+	snapshotCompositor *gst.Bin
+
+	// key is the name of the source (see snapshotSource* constants)
+	snapshots map[string]*snapshotSink
+
+	// optional low-resolution confidence monitor of all inputs
+	multiview        *gst.Bin
+	muxerMultiview   *gst.Bin
+	srtMultiviewSink *gst.Bin
+	// textoverlay rendering the audio meters of the multiview
+	multiviewMeters *gst.Element
+	// optional HLS output of the multiview, fed by splitterMultiview
+	splitterMultiview *gst.Bin
+	hlsMultiviewSink  *gst.Bin
+
+	// optional audio-only output via SRT and Icecast
+	muxerAudio   *gst.Bin
+	srtAudioSink *gst.Bin
+	icecastSink  *gst.Bin
+
+	// name of the output by the name of the elements in its bins, for
+	// attributing warnings
+	outputElements map[string]string
+
+	// key is the name of the source (see source* constants)
+	sourceHeartbeats map[string]*heartbeat
+	// source bins by the name of the source
+	sourceBins map[string]*gst.Bin
+	// formats chosen by probing the devices of V4L2 sources by the name of
+	// the source
+	sourceProbes map[string]*sourceProbe
+
+	// frame counters of the sources, the compositor, and the encoders
+	branches []*branchStats
+
+	// maps the name of an audio source bin to the name of the source
+	audioSources map[string]string
 
 	camSrcCaps     videoCapsFilter
 	presentSrcCaps videoCapsFilter
@@ -50,6 +94,110 @@ type pipeline struct {
 	audioCaps audioCapsFilter
 }
 
+// Names of the sources as exposed via the HTTP API
+const (
+	sourceCamera  = "camera"
+	sourcePresent = "present"
+	sourceAudio   = "audio"
+
+	sourceKindVideo = "video"
+	sourceKindAudio = "audio"
+)
+
+// sourceInfo describes the configuration and state of a source bin
+type sourceInfo struct {
+	name    string
+	kind    string
+	factory string
+	opts    string
+	// caps enforced at the end of the source bin
+	configuredCaps string
+	// caps negotiated on the src pad of the source bin. Empty if not negotiated yet.
+	negotiatedCaps string
+	// A/V offset applied to the timestamps of the source
+	offset time.Duration
+	// formats of the device, nil if the source is not probed
+	probe *sourceProbe
+	// caps negotiated by the Decklink element. Empty for other sources.
+	captureCaps string
+}
+
+func newSourceInfo(name, kind, factory, opts, configuredCaps string, bin *gst.Bin) sourceInfo {
+	info := sourceInfo{
+		name:           name,
+		kind:           kind,
+		factory:        factory,
+		opts:           opts,
+		configuredCaps: strings.Trim(configuredCaps, "\""),
+	}
+
+	if pad := bin.GetStaticPad("src"); pad != nil {
+		if caps := pad.GetCurrentCaps(); caps != nil {
+			info.negotiatedCaps = caps.String()
+		}
+		info.offset = time.Duration(pad.GetOffset())
+	}
+
+	return info
+}
+
+// Returns the names of all sources, the audio inputs in configured order
+func (p *pipeline) sourceNames() []string {
+	names := []string{sourceCamera, sourcePresent}
+	for _, in := range p.audioInputs {
+		names = append(names, in.config.name)
+	}
+	return names
+}
+
+// outputBinNames lists the names of the bins forming an output
+type outputBinNames struct {
+	name string
+	bins []string
+	// nil if the output is not served via SRT
+	srtSink *gst.Bin
+}
+
+// Returns the names of the muxer and sink bins of every output
+func (p *pipeline) outputBins() []outputBinNames {
+	outputs := []outputBinNames{
+		{"combined", []string{p.muxerCompositor.GetName(), p.srtCompositorSink.GetName()}, p.srtCompositorSink},
+		{"present", []string{p.muxerPresent.GetName(), p.srtPresentSink.GetName()}, p.srtPresentSink},
+		{"camera", []string{p.muxerCam.GetName(), p.srtCamSink.GetName()}, p.srtCamSink},
+	}
+	if p.multiview != nil {
+		bins := []string{p.muxerMultiview.GetName(), p.srtMultiviewSink.GetName()}
+		if p.hlsMultiviewSink != nil {
+			bins = append(bins, p.hlsMultiviewSink.GetName())
+		}
+		outputs = append(outputs, outputBinNames{"multiview", bins, p.srtMultiviewSink})
+	}
+	return append(outputs, p.audioOutputBins()...)
+}
+
+// Returns the output of every element in the bins of the outputs, including
+// the bins themselves, by element name
+func (p *pipeline) indexOutputElements() (map[string]string, error) {
+	index := make(map[string]string)
+	for _, output := range p.outputBins() {
+		for _, name := range output.bins {
+			index[name] = output.name
+			bin, err := p.pipeline.GetElementByName(name)
+			if err != nil {
+				return nil, err
+			}
+			elements, err := gst.ToGstBin(bin).GetElementsRecursive()
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range elements {
+				index[e.GetName()] = output.name
+			}
+		}
+	}
+	return index, nil
+}
+
 // get statistics from the combined stream srtsink
 func getSRTStatistics(srtBin *gst.Bin) (*srtStats, error) {
 	sinkName := srtBin.GetName()
@@ -71,15 +219,19 @@ func getSRTStatistics(srtBin *gst.Bin) (*srtStats, error) {
 }
 
 func newPipeline(d *daemonConfig) (*pipeline, error) {
-	p := &pipeline{}
+	p := &pipeline{
+		sourceProbes: make(map[string]*sourceProbe),
+	}
 
-	p.outputCaps = caps1920x1080p30
-	p.presentSrcCaps = caps1920x1080p30
-	p.camSrcCaps = caps1920x1080p30
+	p.outputCaps = d.outputFormat(outputCombined)
+	p.presentSrcCaps = d.sourceFormat(sourcePresent)
+	p.camSrcCaps = d.sourceFormat(sourceCamera)
 	p.audioCaps = capsStereo48Khz
 
-	p.camCompCaps = caps480x270p30
-	p.presentCompCaps = caps1440x810p30
+	// The presentation covers 3/4 of the combined output, the camera is
+	// placed in the top right corner at 1/4 of its size
+	p.camCompCaps = scaleVideoCaps(p.outputCaps, 1, 4)
+	p.presentCompCaps = scaleVideoCaps(p.outputCaps, 3, 4)
 
 	var err error
 
@@ -87,11 +239,15 @@ func newPipeline(d *daemonConfig) (*pipeline, error) {
 
 	switch d.sourceCam {
 	case "videotestsrc":
-		p.camSrc, err = newVideoTestSourceBin("cam", videoPatternSMPTE, p.camSrcCaps)
+		if d.avSyncTest {
+			p.camSrc, err = newSyncTestVideoSourceBin("cam", p.camSrcCaps)
+		} else {
+			p.camSrc, err = newVideoTestSourceBin("cam", videoPatternSMPTE, p.camSrcCaps)
+		}
 	case "v4l2src":
-		p.camSrc, err = newV4L2SourceBin("cam", d.sourceCamOpts, p.camSrcCaps)
+		p.camSrc, err = p.newProbedV4L2SourceBin(sourceCamera, "cam", d.sourceCamOpts, p.camSrcCaps)
 	case "decklinkvideosrc":
-		p.camSrc, err = newDecklinkVideoSourceBin("cam", d.sourceCamOpts, p.camSrcCaps)
+		p.camSrc, err = p.newUnprobedDecklinkSourceBin(sourceCamera, "cam", d.sourceCamOpts, d.videoSettings(sourceCamera), p.camSrcCaps)
 	default:
 		return nil, errors.New("invalid source element factory name for camera channel")
 	}
@@ -101,11 +257,15 @@ func newPipeline(d *daemonConfig) (*pipeline, error) {
 
 	switch d.sourcePresent {
 	case "videotestsrc":
-		p.presentSrc, err = newVideoTestSourceBin("present", videoPatternSMPTE, p.presentSrcCaps)
+		if d.avSyncTest {
+			p.presentSrc, err = newSyncTestVideoSourceBin("present", p.presentSrcCaps)
+		} else {
+			p.presentSrc, err = newVideoTestSourceBin("present", videoPatternSMPTE, p.presentSrcCaps)
+		}
 	case "v4l2src":
-		p.presentSrc, err = newV4L2SourceBin("present", d.sourcePresentOpts, p.presentSrcCaps)
+		p.presentSrc, err = p.newProbedV4L2SourceBin(sourcePresent, "present", d.sourcePresentOpts, p.presentSrcCaps)
 	case "decklinkvideosrc":
-		p.presentSrc, err = newDecklinkVideoSourceBin("present", d.sourcePresentOpts, p.presentSrcCaps)
+		p.presentSrc, err = p.newUnprobedDecklinkSourceBin(sourcePresent, "present", d.sourcePresentOpts, d.videoSettings(sourcePresent), p.presentSrcCaps)
 	default:
 		return nil, errors.New("invalid source element factory name for presentation channel")
 	}
@@ -113,48 +273,40 @@ func newPipeline(d *daemonConfig) (*pipeline, error) {
 		return nil, err
 	}
 
-	audioParams := audioParams{Amplification: d.audioAmplification}
-
-	switch d.sourceAudio {
-	case "audiotestsrc":
-		p.audioSrc, err = newAudioTestSourceBin("master", p.audioCaps, audioParams)
-	case "alsasrc":
-		p.audioSrc, err = newALSASourceBin("master", d.sourceAudioOpts, p.audioCaps, audioParams)
-	case "decklinkaudiosrc":
-		p.audioSrc, err = newDecklinkAudioSourceBin("master", d.sourceAudioOpts, p.audioCaps, audioParams)
-	}
-	if err != nil {
+	if err := p.newAudioBins(d); err != nil {
 		return nil, err
 	}
 
-	p.splitterAudio, err = new1x3SplitterBin("splitter_audio")
-	if err != nil {
-		return nil, err
+	// The multiview requires an additional branch from every video splitter
+	extraVideoOutputs := 0
+	if d.multiview {
+		extraVideoOutputs = 1
 	}
-	p.splitterPresent, err = new1x2SplitterBin("splitter_present")
+
+	p.splitterPresent, err = newSplitterBin("splitter_present", 3+extraVideoOutputs)
 	if err != nil {
 		return nil, err
 	}
-	p.splitterCam, err = new1x2SplitterBin("splitter_cam")
+	p.splitterCam, err = newSplitterBin("splitter_cam", 3+extraVideoOutputs)
 	if err != nil {
 		return nil, err
 	}
 
-	p.muxerPresent, err = newMPEGTSMuxerBin("muxer_present", d.videoEncBitrateKbps, d.audioEncBitrateKbps, d.hwAccel)
+	p.muxerPresent, err = newMPEGTSMuxerBin("muxer_present", d.videoEncBitrateKbps, d.audioEncBitrateKbps, d.hwAccel, d.audioTracks(outputPresent), d.outputConversion(outputPresent, sourcePresent))
 	if err != nil {
 		return nil, err
 	}
-	p.srtPresentSink, err = newSRTSink("sink_present", fmt.Sprintf("srt://%s:%s?mode=listener", d.listenAddr, d.presPort))
+	p.srtPresentSink, err = newSRTSink("sink_present", d.srtURI(d.presPort))
 	if err != nil {
 		return nil, err
 	}
 	p.srtPresentSink.Element.SetProperty("name", "sink_present")
 
-	p.muxerCam, err = newMPEGTSMuxerBin("muxer_cam", d.videoEncBitrateKbps, d.audioEncBitrateKbps, d.hwAccel)
+	p.muxerCam, err = newMPEGTSMuxerBin("muxer_cam", d.videoEncBitrateKbps, d.audioEncBitrateKbps, d.hwAccel, d.audioTracks(outputCamera), d.outputConversion(outputCamera, sourceCamera))
 	if err != nil {
 		return nil, err
 	}
-	p.srtCamSink, err = newSRTSink("sink_cam", fmt.Sprintf("srt://%s:%s?mode=listener", d.listenAddr, d.camPort))
+	p.srtCamSink, err = newSRTSink("sink_cam", d.srtURI(d.camPort))
 	if err != nil {
 		return nil, err
 	}
@@ -180,12 +332,30 @@ func newPipeline(d *daemonConfig) (*pipeline, error) {
 		return nil, err
 	}
 
-	p.muxerCompositor, err = newMPEGTSMuxerBin("muxer_comp", d.videoEncBitrateKbps, d.audioEncBitrateKbps, d.hwAccel)
+	p.splitterCompositor, err = newSplitterBin("splitter_comp", 2+extraVideoOutputs)
 	if err != nil {
 		return nil, err
 	}
 
-	p.srtCompositorSink, err = newSRTSink("sink_combined", fmt.Sprintf("srt://%s:%s?mode=listener", d.listenAddr, d.combPort))
+	p.snapshotPresent, err = newSnapshotBin("snapshot_present", false)
+	if err != nil {
+		return nil, err
+	}
+	p.snapshotCam, err = newSnapshotBin("snapshot_cam", false)
+	if err != nil {
+		return nil, err
+	}
+	p.snapshotCompositor, err = newSnapshotBin("snapshot_comp", d.hwAccel)
+	if err != nil {
+		return nil, err
+	}
+
+	p.muxerCompositor, err = newMPEGTSMuxerBin("muxer_comp", d.videoEncBitrateKbps, d.audioEncBitrateKbps, d.hwAccel, d.audioTracks(outputCombined), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	p.srtCompositorSink, err = newSRTSink("sink_combined", d.srtURI(d.combPort))
 	if err != nil {
 		return nil, err
 	}
@@ -200,13 +370,16 @@ func newPipeline(d *daemonConfig) (*pipeline, error) {
 		// Sources
 		p.camSrc.Element,
 		p.presentSrc.Element,
-		p.audioSrc.Element,
 		// Splitters
 		p.splitterPresent.Element,
 		p.splitterCam.Element,
-		p.splitterAudio.Element,
 		// Processors
 		p.compositor.Element,
+		p.splitterCompositor.Element,
+		// Snapshots
+		p.snapshotPresent.Element,
+		p.snapshotCam.Element,
+		p.snapshotCompositor.Element,
 		// Muxers
 		p.muxerCompositor.Element,
 		p.muxerPresent.Element,
@@ -220,26 +393,197 @@ func newPipeline(d *daemonConfig) (*pipeline, error) {
 		return nil, err
 	}
 
+	// Inputs, mixers, and splitters of the audio
+	if err := p.pipeline.AddMany(p.audioBins()...); err != nil {
+		return nil, err
+	}
+
 	// Link all bins
 	p.presentSrc.Link(p.splitterPresent.Element)
 	p.camSrc.Link(p.splitterCam.Element)
-	p.audioSrc.Link(p.splitterAudio.Element)
 
 	p.splitterPresent.Link(p.compositor.Element)
 	p.splitterPresent.Link(p.muxerPresent.Element)
+	p.splitterPresent.Link(p.snapshotPresent.Element)
 	p.splitterCam.Link(p.compositor.Element)
 	p.splitterCam.Link(p.muxerCam.Element)
-	p.splitterAudio.Link(p.muxerCompositor.Element)
-	p.splitterAudio.Link(p.muxerPresent.Element)
-	p.splitterAudio.Link(p.muxerCam.Element)
+	p.splitterCam.Link(p.snapshotCam.Element)
+	if err := p.linkAudio(d); err != nil {
+		return nil, err
+	}
 
-	p.compositor.Link(p.muxerCompositor.Element)
+	p.compositor.Link(p.splitterCompositor.Element)
+	p.splitterCompositor.Link(p.muxerCompositor.Element)
+	p.splitterCompositor.Link(p.snapshotCompositor.Element)
 
 	p.muxerCompositor.Link(p.srtCompositorSink.Element)
 	p.muxerPresent.Link(p.srtPresentSink.Element)
 	p.muxerCam.Link(p.srtCamSink.Element)
 
+	if d.multiview {
+		if err := p.addMultiview(d); err != nil {
+			return nil, err
+		}
+	}
+	if d.audioOutput || d.audioOutputIcecast != nil {
+		if err := p.addAudioOutput(d); err != nil {
+			return nil, err
+		}
+	}
+
+	p.sourceBins = map[string]*gst.Bin{
+		sourceCamera:  p.camSrc,
+		sourcePresent: p.presentSrc,
+	}
+	p.audioSources = make(map[string]string)
+	for _, in := range p.audioInputs {
+		p.sourceBins[in.config.name] = in.src
+		p.audioSources[in.src.GetName()] = in.config.name
+	}
+	for source, offset := range d.avOffsets {
+		if err := p.setSourceOffset(source, offset); err != nil {
+			return nil, fmt.Errorf("failed to set A/V offset of source '%s': %w", source, err)
+		}
+	}
+	p.sourceHeartbeats = make(map[string]*heartbeat)
+	for source, bin := range p.sourceBins {
+		p.sourceHeartbeats[source] = &heartbeat{}
+		if err := addBufferHeartbeat(bin, p.sourceHeartbeats[source]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, bin := range []*gst.Bin{p.camSrc, p.presentSrc, p.compositor} {
+		b, err := newBinBranchStats(bin)
+		if err != nil {
+			return nil, err
+		}
+		p.branches = append(p.branches, b)
+	}
+	muxers := []*gst.Bin{p.muxerCompositor, p.muxerPresent, p.muxerCam}
+	if p.muxerMultiview != nil {
+		muxers = append(muxers, p.muxerMultiview)
+	}
+	for _, muxer := range muxers {
+		b, err := newEncoderBranchStats(muxer)
+		if err != nil {
+			return nil, err
+		}
+		p.branches = append(p.branches, b)
+	}
+
+	p.snapshots = make(map[string]*snapshotSink)
+	snapshotBins := map[string]*gst.Bin{
+		snapshotSourceCombined: p.snapshotCompositor,
+		snapshotSourcePresent:  p.snapshotPresent,
+		snapshotSourceCamera:   p.snapshotCam,
+	}
+	for source, bin := range snapshotBins {
+		p.snapshots[source], err = newSnapshotSink(bin)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.outputElements, err = p.indexOutputElements()
+	if err != nil {
+		return nil, err
+	}
+
 	p.constructed = true
 
 	return p, nil
 }
+
+// Construct the multiview bins, add them to the pipeline, and link them to the
+// additional splitter outputs.
+func (p *pipeline) addMultiview(d *daemonConfig) error {
+	var err error
+
+	p.multiview, err = newMultiviewBin("multiview", multiviewConfig{
+		TileCaps: caps480x270p15,
+		HwAccel:  d.hwAccel,
+	})
+	if err != nil {
+		return err
+	}
+	// The multiview is encoded in software as the tiles are in system memory
+	p.muxerMultiview, err = newMPEGTSMuxerBin("muxer_multiview", d.multiviewEncBitrateKbps, d.audioEncBitrateKbps, false, d.audioTracks(outputMultiview), nil)
+	if err != nil {
+		return err
+	}
+	p.srtMultiviewSink, err = newSRTSink("sink_multiview", d.srtURI(d.multiviewPort))
+	if err != nil {
+		return err
+	}
+
+	p.multiviewMeters, err = p.multiview.GetElementByName(multiviewMetersName("multiview"))
+	if err != nil {
+		return err
+	}
+	// The multiview video is split if it is additionally written as HLS
+	videoOutputs := 1
+	if d.multiviewHLSDir != "" {
+		videoOutputs = 2
+		p.hlsMultiviewSink, err = newHLSSinkBin("sink_hls_multiview", d.multiviewHLSDir, d.multiviewEncBitrateKbps, d.audioEncBitrateKbps, hlsTargetDuration*caps480x270p15.Framerate.Nominator)
+		if err != nil {
+			return err
+		}
+	}
+	p.splitterMultiview, err = newSplitterBin("splitter_multiview", videoOutputs)
+	if err != nil {
+		return err
+	}
+
+	err = p.pipeline.AddMany(
+		p.multiview.Element,
+		p.splitterMultiview.Element,
+		p.muxerMultiview.Element,
+		p.srtMultiviewSink.Element,
+	)
+	if err != nil {
+		return err
+	}
+	if p.hlsMultiviewSink != nil {
+		if err := p.pipeline.Add(p.hlsMultiviewSink.Element); err != nil {
+			return err
+		}
+	}
+
+	// The multiview uses the additional outputs appended to the splitters
+	links := []struct {
+		splitter *gst.Bin
+		srcPad   string
+		sink     *gst.Bin
+		sinkPad  string
+	}{
+		{p.splitterCompositor, "src_2", p.multiview, "combined_sink"},
+		{p.splitterPresent, "src_3", p.multiview, "present_sink"},
+		{p.splitterCam, "src_3", p.multiview, "camera_sink"},
+	}
+	for _, link := range links {
+		if err := linkPads(link.splitter.Element, link.srcPad, link.sink.Element, link.sinkPad); err != nil {
+			return err
+		}
+	}
+	audioLinks := []audioOutputLink{
+		{outputMultiview, p.muxerMultiview, "audio_sink", true},
+	}
+	if p.hlsMultiviewSink != nil {
+		audioLinks = append(audioLinks, audioOutputLink{outputMultiview, p.hlsMultiviewSink, "audio_sink", false})
+		if err := linkPads(p.splitterMultiview.Element, "src_1", p.hlsMultiviewSink.Element, "video_sink"); err != nil {
+			return err
+		}
+	}
+	if err := p.linkAudioOutputs(d, audioLinks); err != nil {
+		return err
+	}
+	if err := p.multiview.Link(p.splitterMultiview.Element); err != nil {
+		return err
+	}
+	if err := linkPads(p.splitterMultiview.Element, "src_0", p.muxerMultiview.Element, "video_sink"); err != nil {
+		return err
+	}
+
+	return p.muxerMultiview.Link(p.srtMultiviewSink.Element)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+	"github.com/go-gst/go-gst/gst/app"
+)
+
+// Names of the sources a snapshot can be requested for
+const (
+	snapshotSourceCombined = "combined"
+	snapshotSourcePresent  = "present"
+	snapshotSourceCamera   = "camera"
+)
+
+const (
+	// snapshots are served from the last frame if it is no older than this
+	snapshotMaxAge = time.Second
+	// time to wait for the next frame of a source
+	snapshotTimeout = 2 * time.Second
+)
+
+var (
+	errUnknownSnapshotSource = errors.New("unknown snapshot source")
+	errNoSnapshot            = errors.New("no frame has been captured")
+)
+
+// A snapshot is a single JPEG encoded frame
+type snapshot struct {
+	jpeg []byte
+	time time.Time
+}
+
+// snapshotSink captures frames of a snapshot bin on demand. The valve of the
+// bin is closed unless a snapshot is requested, so that no frames are encoded
+// while nobody is watching.
+type snapshotSink struct {
+	valve *gst.Element
+
+	// mu guards the fields below. The appsink callback runs on a streaming
+	// thread.
+	mu   sync.Mutex
+	last snapshot
+	// closed once the next frame has arrived. nil while the valve is closed.
+	next chan struct{}
+}
+
+// Attach a snapshotSink to the valve and appsink inside the snapshot bin
+func newSnapshotSink(bin *gst.Bin) (*snapshotSink, error) {
+	valve, err := bin.GetElementByName("valve_" + bin.GetName())
+	if err != nil {
+		return nil, err
+	}
+	elem, err := bin.GetElementByName("appsink_" + bin.GetName())
+	if err != nil {
+		return nil, err
+	}
+	sink := app.SinkFromElement(elem)
+	if sink == nil {
+		return nil, errors.New("snapshot element is not an appsink")
+	}
+
+	s := &snapshotSink{valve: valve}
+	sink.SetCallbacks(&app.SinkCallbacks{
+		NewSampleFunc: func(appSink *app.Sink) gst.FlowReturn {
+			sample := appSink.PullSample()
+			if sample == nil {
+				return gst.FlowEOS
+			}
+			buf := sample.GetBuffer()
+			if buf == nil {
+				return gst.FlowError
+			}
+
+			// Bytes() copies the mapped memory
+			data := buf.Bytes()
+
+			s.mu.Lock()
+			s.last = snapshot{jpeg: data, time: time.Now()}
+			if s.next != nil {
+				close(s.next)
+				s.next = nil
+				s.valve.SetProperty("drop", true)
+			}
+			s.mu.Unlock()
+
+			return gst.FlowOK
+		},
+	})
+
+	return s, nil
+}
+
+// Returns the last frame if it is recent, or else opens the valve and waits
+// for the next frame
+func (s *snapshotSink) capture() (snapshot, error) {
+	s.mu.Lock()
+	if s.last.jpeg != nil && time.Since(s.last.time) < snapshotMaxAge {
+		defer s.mu.Unlock()
+		return s.last, nil
+	}
+	if s.next == nil {
+		s.next = make(chan struct{})
+		s.valve.SetProperty("drop", false)
+	}
+	next := s.next
+	s.mu.Unlock()
+
+	select {
+	case <-next:
+	case <-time.After(snapshotTimeout):
+		return snapshot{}, errNoSnapshot
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-gst/go-glib/glib"
+	"github.com/go-gst/go-gst/gst"
+)
+
+const (
+	// interval of the main loop heartbeat
+	mainloopHeartbeatInterval = time.Second
+	// the main loop is considered stalled if it has not beaten for this long
+	mainloopStallTimeout = 5 * time.Second
+	// a source is considered stalled if it has not produced a buffer for this long
+	sourceStallTimeout = 5 * time.Second
+	// an output is considered in error for this long after a warning
+	outputWarningTimeout = 30 * time.Second
+)
+
+// A heartbeat records the last time a loop made progress
+type heartbeat struct {
+	last atomic.Int64 // unix nanoseconds
+}
+
+func (h *heartbeat) beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+func (h *heartbeat) since() time.Duration {
+	return time.Since(time.Unix(0, h.last.Load()))
+}
+
+// Beat from a timeout source on the main context. The heartbeat stops if the
+// main loop is blocked.
+func (d *daemon) startMainloopHeartbeat() {
+	d.mainloopHeartbeat.beat()
+	glib.TimeoutAdd(uint(mainloopHeartbeatInterval.Milliseconds()), func() bool {
+		d.mainloopHeartbeat.beat()
+		return true
+	})
+}
+
+// Beat every time a buffer passes the src pad of a bin
+func addBufferHeartbeat(bin *gst.Bin, hb *heartbeat) error {
+	pad := bin.GetStaticPad("src")
+	if pad == nil {
+		return fmt.Errorf("failed to get static pad 'src' from '%s' bin", bin.GetName())
+	}
+	pad.AddProbe(gst.PadProbeTypeBuffer, func(*gst.Pad, *gst.PadProbeInfo) gst.PadProbeReturn {
+		hb.beat()
+		return gst.PadProbeOK
+	})
+	return nil
+}
+
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type healthReport struct {
+	OK      bool          `json:"ok"`
+	Failing []string      `json:"failing"`
+	Checks  []healthCheck `json:"checks"`
+}
+
+func newHealthReport(checks []healthCheck) healthReport {
+	r := healthReport{OK: true, Failing: []string{}, Checks: checks}
+	for _, c := range checks {
+		if !c.OK {
+			r.OK = false
+			r.Failing = append(r.Failing, c.Name)
+		}
+	}
+	return r
+}
+
+func (d *daemon) mainloopCheck() healthCheck {
+	c := healthCheck{Name: "mainloop", OK: true}
+	if since := d.mainloopHeartbeat.since(); since > mainloopStallTimeout {
+		c.OK = false
+		c.Message = fmt.Sprintf("main loop unresponsive for %s", since.Round(time.Second))
+	}
+	return c
+}
+
+// get the liveness of the daemon, i.e. whether the process should be restarted
+func (d *daemon) health() healthReport {
+	return newHealthReport([]healthCheck{d.mainloopCheck()})
+}
+
+// get the readiness of the daemon, i.e. whether it is serving all outputs
+func (d *daemon) readiness() healthReport {
+	d.mu.RLock()
+	p := d.pipeline
+	d.mu.RUnlock()
+	if p == nil {
+		return newHealthReport([]healthCheck{{Name: "pipeline", Message: "pipeline not constructed"}})
+	}
+
+	m := d.metricsSnapshot()
+	checks := []healthCheck{d.mainloopCheck()}
+
+	state := healthCheck{Name: "pipeline", OK: m.pipelineStats.state == gst.StatePlaying}
+	if !state.OK {
+		state.Message = fmt.Sprintf("pipeline is %s", m.pipelineStats.state)
+	}
+	checks = append(checks, state)
+
+	for _, name := range p.sourceNames() {
+		c := healthCheck{Name: "source_" + name, OK: true}
+		if since := p.sourceHeartbeats[name].since(); since > sourceStallTimeout {
+			c.OK = false
+			c.Message = fmt.Sprintf("no buffers for %s", since.Round(time.Second))
+		}
+		checks = append(checks, c)
+	}
+
+	for _, output := range p.outputBins() {
+		c := healthCheck{Name: "output_" + output.name, OK: true}
+		for element, t := range m.pipelineStats.lastWarnings {
+			if p.outputElements[element] == output.name && time.Since(t) < outputWarningTimeout {
+				c.OK = false
+				c.Message = fmt.Sprintf("warning from '%s' %s ago", element, time.Since(t).Round(time.Second))
+			}
+		}
+		checks = append(checks, c)
+	}
+
+	return newHealthReport(checks)
+}
@@ -1,188 +1,41 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-gst/go-gst/gst"
 )
 
 type httpServer struct {
 	daemonController
+	// nil if authentication is disabled
+	auth     *authenticator
+	registry *registry
 }
 
-func writeSRTStatsMeta(w http.ResponseWriter) {
-	fmt.Fprintln(w, "# HELP srt_callers Current number of subscribers to the SRT stream")
-	fmt.Fprintln(w, "# TYPE srt_callers gauge")
-
-	fmt.Fprintln(w, "# HELP srt_send_bytes_total Total bytes sent across all callers")
-	fmt.Fprintln(w, "# TYPE srt_send_bytes_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_send_rate Send rate in Mbps")
-	fmt.Fprintln(w, "# TYPE srt_send_rate gauge")
-
-	fmt.Fprintln(w, "# HELP srt_bandwidth Bandwidth in Mbps")
-	fmt.Fprintln(w, "# TYPE srt_bandwidth gauge")
-
-	fmt.Fprintln(w, "# HELP srt_rtt_seconds RTT in s")
-	fmt.Fprintln(w, "# TYPE srt_rtt_seconds gauge")
-
-	fmt.Fprintln(w, "# HELP srt_negotiated_latency_seconds Negotiated latency in s")
-	fmt.Fprintln(w, "# TYPE srt_negotiated_latency_seconds gauge")
-
-	fmt.Fprintln(w, "# HELP srt_sent_bytes_total Total bytes sent")
-	fmt.Fprintln(w, "# TYPE srt_sent_bytes_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_retransmitted_bytes_total Total bytes retransmitted")
-	fmt.Fprintln(w, "# TYPE srt_retransmitted_bytes_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_sent_dropped_bytes_total Total bytes retransmitted")
-	fmt.Fprintln(w, "# TYPE srt_sent_dropped_bytes_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_packets_sent_total Total packets sent")
-	fmt.Fprintln(w, "# TYPE srt_packets_sent_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_packets_sent_lost_total Total packets lost")
-	fmt.Fprintln(w, "# TYPE srt_packets_sent_lost_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_packets_sent_dropped_total Total packets dropped")
-	fmt.Fprintln(w, "# TYPE srt_packets_sent_dropped_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_packets_retransmitted_total Total packets retransmitted")
-	fmt.Fprintln(w, "# TYPE srt_packets_retransmitted_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_packets_ack_received_total Number of acks received")
-	fmt.Fprintln(w, "# TYPE srt_packets_ack_received_total counter")
-
-	fmt.Fprintln(w, "# HELP srt_packets_nack_received_total Number of nacks received")
-	fmt.Fprintln(w, "# TYPE srt_packets_nack_received_total counter")
-}
-
-func writeSRTStats(w http.ResponseWriter, s *srtStats, sink string) {
-	srtTime := s.time.UnixMilli()
-	fmt.Fprintf(w, "srt_callers{sink=\"%s\"} %d %d\n", sink, len(s.callers), srtTime)
-
-	// Total bytes sent
-	fmt.Fprintf(w, "srt_send_bytes_total{sink=\"%s\"} %d %d\n", sink, s.bytesSendTotal, srtTime)
-
-	// Send rate per caller
-	for _, caller := range s.callers {
-		common := fmt.Sprintf("address=\"%s\", port=\"%d\", sink=\"%s\"", caller.callerAddress.String(), caller.callerPort, sink)
-
-		// Send Rate
-		fmt.Fprintf(w, "srt_send_rate{%s} %f %d\n", common, caller.sendRateMbps, srtTime)
-
-		// Bandwidth
-		fmt.Fprintf(w, "srt_bandwidth{%s} %f %d\n", common, caller.bandwidthMbps, srtTime)
-
-		// Round-trip time (RTT)
-		fmt.Fprintf(w, "srt_rtt_seconds{%s} %f %d\n", common, caller.rttMS/1000, srtTime)
-
-		// Negotiated Latency
-		fmt.Fprintf(w, "srt_negotiated_latency_seconds{%s} %d %d\n", common, caller.negotiatedLatencyMS/1000, srtTime)
-
-		// Bytes sent
-		fmt.Fprintf(w, "srt_sent_bytes_total{%s} %d %d\n", common, caller.bytesSent, srtTime)
-
-		// Bytes Retransmitted
-		fmt.Fprintf(w, "srt_retransmitted_bytes_total{%s} %d %d\n", common, caller.bytesRetransmitted, srtTime)
-
-		// Bytes Sent Dropped
-		fmt.Fprintf(w, "srt_sent_dropped_bytes_total{%s} %d %d\n", common, caller.bytesSentDropped, srtTime)
-
-		// Packets sent
-		fmt.Fprintf(w, "srt_packets_sent_total{%s} %d %d\n", common, caller.packetsSent, srtTime)
-
-		// Packets Sent Lost
-		fmt.Fprintf(w, "srt_packets_sent_lost_total{%s} %d %d\n", common, caller.packetsSentLost, srtTime)
-
-		// Packets Sent Dropped
-		fmt.Fprintf(w, "srt_packets_sent_dropped_total{%s} %d %d\n", common, caller.packetsSentDropped, srtTime)
-
-		// Packets Retransmitted
-		fmt.Fprintf(w, "srt_packets_retransmitted_total{%s} %d %d\n", common, caller.packetsRetransmitted, srtTime)
-
-		// Packets Ack Received
-		fmt.Fprintf(w, "srt_packets_ack_received_total{%s} %d %d\n", common, caller.packetAckReceived, srtTime)
-
-		// Packets Nack Received
-		fmt.Fprintf(w, "srt_packets_nack_received_total{%s} %d %d\n", common, caller.packetNackReceived, srtTime)
-	}
-
-}
-
-// Minimalist prometheus exporter
+// Prometheus exporter. Serves OpenMetrics if requested by the scraper via the
+// Accept header or with '?format=openmetrics'.
 func (h *httpServer) metrics(w http.ResponseWriter, r *http.Request) {
 	m := h.metricsSnapshot()
+	families := h.registry.gather(&m)
 
-	/* CPU */
-
-	cpuTime := m.cpu.Time.UnixMilli()
-	fmt.Fprintf(w, "# HELP linux_proc_user_total Time spent in user mode, in ticks\n")
-	fmt.Fprintf(w, "# TYPE linux_proc_user_total counter\n")
-	fmt.Fprintf(w, "linux_proc_user_total %d %d\n", m.cpu.User, cpuTime)
-
-	fmt.Fprintf(w, "# HELP linux_proc_system_total Time spent in system mode, in ticks\n")
-	fmt.Fprintf(w, "# TYPE linux_proc_system_total counter\n")
-	fmt.Fprintf(w, "linux_proc_system_total %d %d\n", m.cpu.System, cpuTime)
-
-	fmt.Fprintf(w, "# HELP linux_proc_iowait_total Time spent waiting for I/O to complete, in ticks\n")
-	fmt.Fprintf(w, "# TYPE linux_proc_iowait_total counter\n")
-	fmt.Fprintf(w, "linux_proc_iowait_total %d %d\n", m.cpu.Iowait, cpuTime)
-
-	fmt.Fprintf(w, "# HELP linux_proc_irq_total Time spent servicing interrupts, in ticks\n")
-	fmt.Fprintf(w, "# TYPE linux_proc_irq_total counter\n")
-	fmt.Fprintf(w, "linux_proc_irq_total %d %d\n", m.cpu.Irq, cpuTime)
-
-	fmt.Fprintf(w, "# HELP linux_proc_softirq_total Time spent servicing soft interrupts, in ticks\n")
-	fmt.Fprintf(w, "# TYPE linux_proc_softirq_total counter\n")
-	fmt.Fprintf(w, "linux_proc_softirq_total %d %d\n", m.cpu.SoftIrq, cpuTime)
-
-	/* Memory */
-
-	memTime := m.mem.Time.UnixMilli()
-	fmt.Fprintf(w, "# HELP linux_mem_used_bytes Amount of memory used, in bytes\n")
-	fmt.Fprintf(w, "# TYPE linux_mem_used_bytes gauge\n")
-	fmt.Fprintf(w, "linux_mem_used_bytes %d %d\n", m.mem.MemUsed*1024, memTime)
-
-	fmt.Fprintf(w, "# HELP linux_mem_free_bytes Amount of free memory, in bytes\n")
-	fmt.Fprintf(w, "# TYPE linux_mem_free_bytes gauge\n")
-	fmt.Fprintf(w, "linux_mem_free_bytes %d %d\n", m.mem.MemFree*1024, memTime)
-
-	/* TODO(hugo) I/O Status metrics via `iostat` when recording is implemented */
-
-	/* Load Average */
-
-	// The timestamp is an int64 (milliseconds since epoch, i.e. 1970-01-01
-	// 00:00:00 UTC, excluding leap seconds), represented as required by Go's
-	// ParseInt() function.
-	loadAvgTime := m.loadAvg.Time.UnixMilli()
-	fmt.Fprintf(w, "# HELP load_avg_one Load average over one minute\n")
-	fmt.Fprintf(w, "# TYPE load_avg_one gauge\n")
-	fmt.Fprintf(w, "load_avg_one %f %d\n", m.loadAvg.One, loadAvgTime)
-
-	fmt.Fprintf(w, "# HELP load_avg_five Load average over five minutes\n")
-	fmt.Fprintf(w, "# TYPE load_avg_five gauge\n")
-	fmt.Fprintf(w, "load_avg_five %f %d\n", m.loadAvg.Five, loadAvgTime)
-
-	fmt.Fprintf(w, "# HELP load_avg_fifteen Load average over fifteen minutes\n")
-	fmt.Fprintf(w, "# TYPE load_avg_fifteen gauge\n")
-	fmt.Fprintf(w, "load_avg_fifteen %f %d\n", m.loadAvg.Fifteen, loadAvgTime)
-
-	/* SRT Statistics */
-
-	writeSRTStatsMeta(w)
-	writeSRTStats(w, &m.compSinkStats, "combined")
-	writeSRTStats(w, &m.presentSinkStats, "present")
-	writeSRTStats(w, &m.camSinkStats, "camera")
-
-	/* GStreamer Statistics */
-
-	for k, v := range m.pipelineStats.qosEvents {
-		fmt.Fprintf(w, "# HELP gst_qos_events_total Number of qos events\n")
-		fmt.Fprintf(w, "# TYPE gst_qos_events_total gauge\n")
-		fmt.Fprintf(w, "gst_qos_events_total{source=\"%s\"} %d\n", k, v)
+	if r.URL.Query().Get("format") == "openmetrics" || strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", contentTypeOpenMetrics)
+		writeOpenMetrics(w, families)
+		return
 	}
+	w.Header().Set("Content-Type", contentTypePrometheusText)
+	writePrometheusText(w, families)
 }
 
 const (
@@ -219,12 +72,220 @@ func (h *httpServer) graph(w http.ResponseWriter, r *http.Request) {
 		details = gst.DebugGraphShowStates
 	}
 
-	dot := h.daemonController.graph(details)
-	w.Write([]byte(dot))
-	w.Header().Add("Content-Type", "text/vnd.graphviz")
+	// Parameters include device paths and SRT URIs.
+	// Graphs from the history are recorded with all details.
+	if details&(gst.DebugGraphShowNonDefaultParams|gst.DebugGraphShowPullParams) != 0 && !requestHasScope(r, scopeControl) {
+		http.Error(w, fmt.Sprintf("forbidden: details '%s' require scope '%s'", val, scopeControl), http.StatusForbidden)
+		return
+	}
+	if q.Get("id") != "" && !requestHasScope(r, scopeControl) {
+		http.Error(w, fmt.Sprintf("forbidden: graphs from the history require scope '%s'", scopeControl), http.StatusForbidden)
+		return
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = graphFormatDOT
+	}
+	contentType, ok := graphContentTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported format '%s'", format), http.StatusBadRequest)
+		return
+	}
+
+	var dot string
+	if val := q.Get("id"); val != "" {
+		id, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid id '%s'", val), http.StatusBadRequest)
+			return
+		}
+		snap, ok := h.daemonController.graphFromHistory(id)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no graph with id %d in history", id), http.StatusNotFound)
+			return
+		}
+		dot = snap.dot
+	} else {
+		dot = h.daemonController.graph(details)
+		if dot == "" {
+			http.Error(w, errPipelineNotConstructed.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	data, err := renderGraph(r.Context(), dot, format)
+	if errors.Is(err, errGraphvizUnavailable) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+type graphHistoryEntry struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// Lists the filter graphs recorded on state changes, oldest first
+func (h *httpServer) graphHistory(w http.ResponseWriter, r *http.Request) {
+	entries := []graphHistoryEntry{}
+	for _, snap := range h.daemonController.graphHistory() {
+		entries = append(entries, graphHistoryEntry{ID: snap.id, Time: snap.time, Reason: snap.reason})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+const (
+	snapshotFormatJPEG = "jpeg"
+	snapshotFormatPNG  = "png"
+)
+
+// Downscale img to the given width while keeping the aspect ratio. Every
+// destination pixel is the average of the source pixels it covers.
+func scaleImage(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if width <= 0 || width >= b.Dx() {
+		return img
+	}
+	height := max(b.Dy()*width/b.Dx(), 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := max(b.Min.X+(x+1)*b.Dx()/width, x0+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					bl += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(bl / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+
+	return dst
+}
+
+// Returns the latest frame of a source as JPEG or PNG. The optional width
+// query parameter downscales the frame to a thumbnail.
+func (h *httpServer) snapshot(w http.ResponseWriter, r *http.Request) {
+	source := strings.TrimPrefix(r.URL.Path, "/snapshot/")
+
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = snapshotFormatJPEG
+	}
+	if format != snapshotFormatJPEG && format != snapshotFormatPNG {
+		http.Error(w, fmt.Sprintf("unsupported format '%s'", format), http.StatusBadRequest)
+		return
+	}
+
+	width := 0
+	if val := q.Get("width"); val != "" {
+		var err error
+		width, err = strconv.Atoi(val)
+		if err != nil || width <= 0 {
+			http.Error(w, fmt.Sprintf("invalid width '%s'", val), http.StatusBadRequest)
+			return
+		}
+	}
+
+	snap, err := h.daemonController.snapshot(source)
+	if errors.Is(err, errUnknownSnapshotSource) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Last-Modified", snap.time.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	// Serve the frame as encoded by the pipeline
+	if format == snapshotFormatJPEG && width == 0 {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(snap.jpeg)
+		return
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(snap.jpeg))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+	img = scaleImage(img, width)
+
+	var buf bytes.Buffer
+	switch format {
+	case snapshotFormatJPEG:
+		err = jpeg.Encode(&buf, img, nil)
+	case snapshotFormatPNG:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/"+format)
+	w.Write(buf.Bytes())
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// Liveness probe: the process is alive and the main loop is responsive
+func (h *httpServer) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, h.health())
+}
+
+// Readiness probe: the pipeline is playing, all sources produce buffers, and
+// no output is in error
+func (h *httpServer) readyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, h.readiness())
 }
 
 func (h *httpServer) setupHTTPHandlers() {
-	http.HandleFunc("/metrics", h.metrics)
-	http.HandleFunc("/graph", h.graph)
+	// Probes are unauthenticated for load balancers and monitoring
+	http.HandleFunc("/healthz", h.healthz)
+	http.HandleFunc("/readyz", h.readyz)
+
+	h.registry = newMetricsRegistry()
+	http.HandleFunc("/metrics", h.withScope(scopeRead, h.metrics))
+	http.HandleFunc("/graph", h.withScope(scopeRead, h.graph))
+	http.HandleFunc("/graph/history", h.withScope(scopeRead, h.graphHistory))
+	http.HandleFunc("/snapshot/", h.withScope(scopeRead, h.snapshot))
+
+	h.setupAPIHandlers()
+	h.setupDashboardHandlers()
+	h.setupHLSHandlers()
 }
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const apiPrefix = "/api/v1"
+
+// An apiError is returned by API handlers to respond with a status code other
+// than 500.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func newAPIError(status int, format string, a ...any) error {
+	return &apiError{status: status, err: fmt.Errorf(format, a...)}
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// An apiRoute is a JSON endpoint of the versioned API. The OpenAPI
+// description is generated from the route table, so every route declares the
+// types of its request and response body.
+type apiRoute struct {
+	method  string
+	path    string // relative to apiPrefix, may contain wildcards e.g. '{name}'
+	summary string
+	scope   string // scope required to access the route
+	// zero values of the request and response body types. request is nil if
+	// the route does not accept a body.
+	request  any
+	response any
+	handler  func(r *http.Request) (any, error)
+}
+
+type apiCaller struct {
+	Address              string  `json:"address"`
+	Port                 uint16  `json:"port"`
+	SendRateMbps         float64 `json:"sendRateMbps"`
+	BandwidthMbps        float64 `json:"bandwidthMbps"`
+	RTTMS                float64 `json:"rttMs"`
+	NegotiatedLatencyMS  int     `json:"negotiatedLatencyMs"`
+	BytesSent            uint64  `json:"bytesSent"`
+	BytesRetransmitted   uint64  `json:"bytesRetransmitted"`
+	BytesSentDropped     uint64  `json:"bytesSentDropped"`
+	PacketsSent          int64   `json:"packetsSent"`
+	PacketsSentLost      int     `json:"packetsSentLost"`
+	PacketsSentDropped   int     `json:"packetsSentDropped"`
+	PacketsRetransmitted int     `json:"packetsRetransmitted"`
+	PacketAckReceived    int     `json:"packetAckReceived"`
+	PacketNackReceived   int     `json:"packetNackReceived"`
+}
+
+type apiOutput struct {
+	Name string `json:"name"`
+	// empty unless the client is granted the control scope
+	URI            string      `json:"uri"`
+	BytesSentTotal uint64      `json:"bytesSentTotal"`
+	Callers        []apiCaller `json:"callers"`
+	Time           time.Time   `json:"time"`
+}
+
+type apiSource struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Factory string `json:"factory"`
+	// empty unless the client is granted the control scope
+	Options        string `json:"options"`
+	ConfiguredCaps string `json:"configuredCaps"`
+	NegotiatedCaps string `json:"negotiatedCaps"`
+	// A/V offset of the source, positive if delayed
+	OffsetMS float64 `json:"offsetMs"`
+	// only set for sources whose device is probed
+	Probe *apiSourceProbe `json:"probe,omitempty"`
+	// caps of the detected mode of Decklink sources
+	CaptureCaps string `json:"captureCaps,omitempty"`
+}
+
+type apiSourceProbe struct {
+	// caps requested from the device
+	ChosenCaps string `json:"chosenCaps"`
+	// whether the chosen caps are converted to the configured caps
+	Converted     bool     `json:"converted"`
+	AvailableCaps []string `json:"availableCaps"`
+}
+
+type apiSourceOffset struct {
+	OffsetMS float64 `json:"offsetMs"`
+}
+
+type apiConfiguration struct {
+	ListenAddress       string  `json:"listenAddress"`
+	VideoEncBitrateKbps int     `json:"videoEncBitrateKbps"`
+	AudioEncBitrateKbps int     `json:"audioEncBitrateKbps"`
+	AudioAmplification  float64 `json:"audioAmplification"`
+	HwAccel             bool    `json:"hwAccel"`
+	Multiview           bool    `json:"multiview"`
+}
+
+type apiPipeline struct {
+	State         string            `json:"state"`
+	Warnings      uint64            `json:"warnings"`
+	QoSEvents     map[string]uint64 `json:"qosEvents"`
+	Configuration apiConfiguration  `json:"configuration"`
+}
+
+type apiCPU struct {
+	User    uint64 `json:"user"`
+	System  uint64 `json:"system"`
+	Iowait  uint64 `json:"iowait"`
+	Irq     uint64 `json:"irq"`
+	SoftIrq uint64 `json:"softIrq"`
+}
+
+type apiSystem struct {
+	CPU          apiCPU     `json:"cpu"`
+	MemUsedBytes uint64     `json:"memUsedBytes"`
+	MemFreeBytes uint64     `json:"memFreeBytes"`
+	LoadAvg      [3]float64 `json:"loadAvg"`
+}
+
+type apiAudioChannel struct {
+	RMSDB  float64 `json:"rmsDb"`
+	PeakDB float64 `json:"peakDb"`
+}
+
+type apiLoudness struct {
+	MomentaryLUFS  float64 `json:"momentaryLufs"`
+	ShortTermLUFS  float64 `json:"shortTermLufs"`
+	IntegratedLUFS float64 `json:"integratedLufs"`
+	RangeLU        float64 `json:"rangeLu"`
+}
+
+type apiAudioDSP struct {
+	// empty if disabled
+	NoiseSuppression string `json:"noiseSuppression"`
+	GainControl      bool   `json:"gainControl"`
+	EchoCancel       bool   `json:"echoCancel"`
+	Voice            bool   `json:"voice"`
+}
+
+type apiAudioLevel struct {
+	Source   string            `json:"source"`
+	Time     time.Time         `json:"time"`
+	Channels []apiAudioChannel `json:"channels"`
+	Silent   bool              `json:"silent"`
+	Clipping bool              `json:"clipping"`
+	// only set if audio processing is enabled for the source
+	Loudness *apiLoudness `json:"loudness,omitempty"`
+	// only set if webrtcdsp is enabled for the source
+	DSP *apiAudioDSP `json:"dsp,omitempty"`
+}
+
+// nil fields are left unchanged
+type apiAudioInputUpdate struct {
+	Mute          *bool    `json:"mute,omitempty"`
+	GainDB        *float64 `json:"gainDb,omitempty"`
+	Amplification *float64 `json:"amplification,omitempty"`
+}
+
+type apiAudioInput struct {
+	Source        string  `json:"source"`
+	Mute          bool    `json:"mute"`
+	GainDB        float64 `json:"gainDb"`
+	Amplification float64 `json:"amplification"`
+}
+
+type apiStatus struct {
+	Time     time.Time   `json:"time"`
+	Pipeline apiPipeline `json:"pipeline"`
+	System   apiSystem   `json:"system"`
+	Outputs  []apiOutput `json:"outputs"`
+}
+
+func newAPIOutput(name string, uri string, s *srtStats) apiOutput {
+	o := apiOutput{
+		Name:           name,
+		URI:            uri,
+		BytesSentTotal: s.bytesSendTotal,
+		Callers:        []apiCaller{},
+		Time:           s.time,
+	}
+	for _, c := range s.callers {
+		o.Callers = append(o.Callers, apiCaller{
+			Address:              c.callerAddress.String(),
+			Port:                 c.callerPort,
+			SendRateMbps:         c.sendRateMbps,
+			BandwidthMbps:        c.bandwidthMbps,
+			RTTMS:                c.rttMS,
+			NegotiatedLatencyMS:  c.negotiatedLatencyMS,
+			BytesSent:            c.bytesSent,
+			BytesRetransmitted:   c.bytesRetransmitted,
+			BytesSentDropped:     c.bytesSentDropped,
+			PacketsSent:          c.packetsSent,
+			PacketsSentLost:      c.packetsSentLost,
+			PacketsSentDropped:   c.packetsSentDropped,
+			PacketsRetransmitted: c.packetsRetransmitted,
+			PacketAckReceived:    c.packetAckReceived,
+			PacketNackReceived:   c.packetNackReceived,
+		})
+	}
+
+	return o
+}
+
+// The URIs of the outputs are only returned to clients granted the control
+// scope
+func (h *httpServer) apiOutputs(r *http.Request, m *metrics) []apiOutput {
+	c := h.config()
+	outputs := make([]apiOutput, 0, len(m.srtSinks))
+	for i := range m.srtSinks {
+		sink := &m.srtSinks[i]
+		uri := ""
+		if requestHasScope(r, scopeControl) {
+			uri = c.outputSRTURI(sink.output)
+		}
+		outputs = append(outputs, newAPIOutput(sink.output, uri, &sink.stats))
+	}
+	return outputs
+}
+
+func (h *httpServer) apiPipeline(m *metrics) apiPipeline {
+	c := h.config()
+	return apiPipeline{
+		State:     m.pipelineStats.state.String(),
+		Warnings:  m.pipelineStats.warnings,
+		QoSEvents: m.pipelineStats.qosEvents,
+		Configuration: apiConfiguration{
+			ListenAddress:       c.listenAddr,
+			VideoEncBitrateKbps: c.videoEncBitrateKbps,
+			AudioEncBitrateKbps: c.audioEncBitrateKbps,
+			AudioAmplification:  c.audioAmplification,
+			HwAccel:             c.hwAccel,
+			Multiview:           c.multiview,
+		},
+	}
+}
+
+func (h *httpServer) apiGetStatus(r *http.Request) (any, error) {
+	m := h.metricsSnapshot()
+
+	return apiStatus{
+		Time:     time.Now(),
+		Pipeline: h.apiPipeline(&m),
+		System: apiSystem{
+			CPU: apiCPU{
+				User:    m.cpu.User,
+				System:  m.cpu.System,
+				Iowait:  m.cpu.Iowait,
+				Irq:     m.cpu.Irq,
+				SoftIrq: m.cpu.SoftIrq,
+			},
+			MemUsedBytes: m.mem.MemUsed * 1024,
+			MemFreeBytes: m.mem.MemFree * 1024,
+			LoadAvg:      [3]float64{m.loadAvg.One, m.loadAvg.Five, m.loadAvg.Fifteen},
+		},
+		Outputs: h.apiOutputs(r, &m),
+	}, nil
+}
+
+func (h *httpServer) apiGetOutputs(r *http.Request) (any, error) {
+	m := h.metricsSnapshot()
+	return h.apiOutputs(r, &m), nil
+}
+
+func (h *httpServer) apiGetOutput(r *http.Request) (any, error) {
+	name := r.PathValue("name")
+	m := h.metricsSnapshot()
+	for _, o := range h.apiOutputs(r, &m) {
+		if o.Name == name {
+			return o, nil
+		}
+	}
+	return nil, newAPIError(http.StatusNotFound, "unknown output '%s'", name)
+}
+
+// The options of the source, which include device paths, are only returned
+// to clients granted the control scope
+func newAPISource(r *http.Request, s *sourceInfo) apiSource {
+	a := apiSource{
+		Name:           s.name,
+		Kind:           s.kind,
+		Factory:        s.factory,
+		ConfiguredCaps: s.configuredCaps,
+		NegotiatedCaps: s.negotiatedCaps,
+		OffsetMS:       float64(s.offset) / float64(time.Millisecond),
+		CaptureCaps:    s.captureCaps,
+	}
+	if requestHasScope(r, scopeControl) {
+		a.Options = s.opts
+	}
+	if s.probe != nil {
+		a.Probe = &apiSourceProbe{
+			ChosenCaps:    s.probe.deviceCaps(),
+			Converted:     s.probe.converted,
+			AvailableCaps: s.probe.available,
+		}
+	}
+	return a
+}
+
+func (h *httpServer) apiGetSources(r *http.Request) (any, error) {
+	sources := []apiSource{}
+	for _, s := range h.sources() {
+		sources = append(sources, newAPISource(r, &s))
+	}
+	return sources, nil
+}
+
+func (h *httpServer) apiSetSourceOffset(r *http.Request) (any, error) {
+	name := r.PathValue("name")
+	var req apiSourceOffset
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	offset := time.Duration(req.OffsetMS * float64(time.Millisecond))
+	if err := validateAVOffset(offset); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+
+	err := h.setSourceOffset(name, offset)
+	if errors.Is(err, errUnknownSource) {
+		return nil, newAPIError(http.StatusNotFound, "unknown source '%s'", name)
+	}
+	if errors.Is(err, errPipelineNotConstructed) {
+		return nil, newAPIError(http.StatusServiceUnavailable, "%v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range h.sources() {
+		if s.name == name {
+			return newAPISource(r, &s), nil
+		}
+	}
+	return nil, newAPIError(http.StatusNotFound, "unknown source '%s'", name)
+}
+
+func newAPIAudioLevel(source string, a *audioStats) apiAudioLevel {
+	l := apiAudioLevel{
+		Source:   source,
+		Time:     a.time,
+		Channels: []apiAudioChannel{},
+		Silent:   a.silence.active,
+		Clipping: a.clipping.active,
+	}
+	for i := range min(len(a.rmsDB), len(a.peakDB)) {
+		l.Channels = append(l.Channels, apiAudioChannel{RMSDB: a.rmsDB[i], PeakDB: a.peakDB[i]})
+	}
+	if a.loudness != nil {
+		l.Loudness = &apiLoudness{
+			MomentaryLUFS:  a.loudness.momentaryLUFS,
+			ShortTermLUFS:  a.loudness.shortTermLUFS,
+			IntegratedLUFS: a.loudness.integratedLUFS,
+			RangeLU:        a.loudness.rangeLU,
+		}
+	}
+	if a.dsp != nil {
+		l.DSP = &apiAudioDSP{
+			NoiseSuppression: a.dsp.noiseSuppression,
+			GainControl:      a.dsp.gainControl,
+			EchoCancel:       a.dsp.echoCancel,
+			Voice:            a.dsp.voice,
+		}
+	}
+	return l
+}
+
+func (h *httpServer) apiGetAudioLevels(r *http.Request) (any, error) {
+	m := h.metricsSnapshot()
+	levels := []apiAudioLevel{}
+	for _, source := range slices.Sorted(maps.Keys(m.audio)) {
+		a := m.audio[source]
+		levels = append(levels, newAPIAudioLevel(source, &a))
+	}
+	return levels, nil
+}
+
+func (h *httpServer) apiGetAudioLevel(r *http.Request) (any, error) {
+	name := r.PathValue("name")
+	m := h.metricsSnapshot()
+	a, ok := m.audio[name]
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "unknown audio source '%s'", name)
+	}
+	return newAPIAudioLevel(name, &a), nil
+}
+
+func (h *httpServer) apiUpdateAudioInput(r *http.Request) (any, error) {
+	name := r.PathValue("name")
+	var req apiAudioInputUpdate
+	if err := decodeJSONBody(r, &req); err != nil {
+		return nil, err
+	}
+	u := audioInputUpdate{mute: req.Mute, gainDB: req.GainDB, amplification: req.Amplification}
+	if err := u.validate(); err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "%v", err)
+	}
+
+	a, err := h.updateAudioInput(name, u)
+	switch {
+	case errors.Is(err, errUnknownSource):
+		return nil, newAPIError(http.StatusNotFound, "unknown audio input '%s'", name)
+	case errors.Is(err, errUnsupportedAudioSetting):
+		return nil, newAPIError(http.StatusBadRequest, "%v", err)
+	case errors.Is(err, errPipelineNotConstructed):
+		return nil, newAPIError(http.StatusServiceUnavailable, "%v", err)
+	case err != nil:
+		return nil, err
+	}
+
+	return apiAudioInput{Source: name, Mute: a.Mute, GainDB: a.GainDB, Amplification: a.Amplification}, nil
+}
+
+func (h *httpServer) apiGetPipeline(r *http.Request) (any, error) {
+	m := h.metricsSnapshot()
+	return h.apiPipeline(&m), nil
+}
+
+func (h *httpServer) apiRoutes() []apiRoute {
+	return []apiRoute{
+		{
+			method:   http.MethodGet,
+			path:     "/status",
+			summary:  "Pipeline state, system metrics, and outputs",
+			scope:    scopeRead,
+			response: apiStatus{},
+			handler:  h.apiGetStatus,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/outputs",
+			summary:  "All outputs with their SRT callers",
+			scope:    scopeRead,
+			response: []apiOutput{},
+			handler:  h.apiGetOutputs,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/outputs/{name}",
+			summary:  "A single output with its SRT callers",
+			scope:    scopeRead,
+			response: apiOutput{},
+			handler:  h.apiGetOutput,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/sources",
+			summary:  "Configuration and negotiated caps of all sources",
+			scope:    scopeRead,
+			response: []apiSource{},
+			handler:  h.apiGetSources,
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/sources/{name}/offset",
+			summary:  "Set the A/V offset of a source",
+			scope:    scopeControl,
+			request:  apiSourceOffset{},
+			response: apiSource{},
+			handler:  h.apiSetSourceOffset,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/pipeline",
+			summary:  "Pipeline state, statistics, and configuration",
+			scope:    scopeRead,
+			response: apiPipeline{},
+			handler:  h.apiGetPipeline,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/audio",
+			summary:  "Levels and silence and clipping state of all audio sources",
+			scope:    scopeRead,
+			response: []apiAudioLevel{},
+			handler:  h.apiGetAudioLevels,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/audio/{name}",
+			summary:  "Levels and silence and clipping state of a single audio source",
+			scope:    scopeRead,
+			response: apiAudioLevel{},
+			handler:  h.apiGetAudioLevel,
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/audio/{name}",
+			summary:  "Set the mute, gain, and amplification of an audio input",
+			scope:    scopeControl,
+			request:  apiAudioInputUpdate{},
+			response: apiAudioInput{},
+			handler:  h.apiUpdateAudioInput,
+		},
+	}
+}
+
+// Decode the JSON request body into v, rejecting unknown fields
+func decodeJSONBody(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return newAPIError(http.StatusBadRequest, "invalid request body: %v", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Wrap an API handler into a http.HandlerFunc encoding the result as JSON
+func (route *apiRoute) handlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := route.handler(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			var apiErr *apiError
+			if errors.As(err, &apiErr) {
+				status = apiErr.status
+			}
+			writeJSON(w, status, apiErrorResponse{Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (h *httpServer) setupAPIHandlers() {
+	routes := h.apiRoutes()
+	for i := range routes {
+		route := &routes[i]
+		http.HandleFunc(route.method+" "+apiPrefix+route.path, h.withScope(route.scope, route.handlerFunc()))
+	}
+
+	http.HandleFunc("GET "+apiPrefix+"/openapi.json", h.withScope(scopeRead, openAPIHandler(routes)))
+}
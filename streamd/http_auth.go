@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// Scopes restrict which routes an identity may access
+const (
+	// read-only access to metrics, snapshots, the filter graph, and the API
+	scopeRead = "read"
+	// control actions that change the state of the daemon, and access to
+	// sensitive information such as device paths and SRT URIs
+	scopeControl = "control"
+)
+
+// An authIdentity is a client authenticated by a bearer token or a client
+// certificate
+type authIdentity struct {
+	name   string
+	scopes []string
+}
+
+func (i *authIdentity) hasScope(scope string) bool {
+	return slices.Contains(i.scopes, scope)
+}
+
+// authenticator authenticates requests with bearer tokens and, if the HTTP
+// server uses TLS with client certificates, verified client certificates.
+//
+// Tokens are loaded from a file with one identity per line:
+//
+//	# <name> <scope>[,<scope>...] <token>
+//	grafana read 6c1f0b0a...
+//	operator read,control 9d3e7a51...
+//
+// A verified client certificate is mapped to the identity whose name matches
+// the Common Name of the certificate subject.
+type authenticator struct {
+	// key is the SHA-256 hash of the token, which avoids leaking the token
+	// through the timing of the map lookup.
+	tokens map[[sha256.Size]byte]*authIdentity
+	// key is the name of the identity
+	names map[string]*authIdentity
+}
+
+func loadAuthenticator(path string) (*authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &authenticator{
+		tokens: make(map[[sha256.Size]byte]*authIdentity),
+		names:  make(map[string]*authIdentity),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected '<name> <scopes> <token>'", path, lineNo)
+		}
+
+		identity := &authIdentity{name: fields[0], scopes: strings.Split(fields[1], ",")}
+		for _, scope := range identity.scopes {
+			if scope != scopeRead && scope != scopeControl {
+				return nil, fmt.Errorf("%s:%d: unknown scope '%s'", path, lineNo, scope)
+			}
+		}
+		if _, ok := a.names[identity.name]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate name '%s'", path, lineNo, identity.name)
+		}
+
+		a.tokens[sha256.Sum256([]byte(fields[2]))] = identity
+		a.names[identity.name] = identity
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Returns the identity of the client or nil if the request is not authenticated
+func (a *authenticator) authenticate(r *http.Request) *authIdentity {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return a.tokens[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+		}
+		return nil
+	}
+
+	// The certificate chain has already been verified during the handshake
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return a.names[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+	}
+
+	return nil
+}
+
+type authIdentityKey struct{}
+
+// Returns whether the client of the request was granted scope. Always true
+// if authentication is disabled.
+func requestHasScope(r *http.Request, scope string) bool {
+	identity, ok := r.Context().Value(authIdentityKey{}).(*authIdentity)
+	if !ok {
+		return true
+	}
+	return identity.hasScope(scope)
+}
+
+// statusRecorder captures the status code for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Wrap handler so that it is only accessible to clients granted scope.
+// Requests requiring the control scope are written to the audit log.
+func (h *httpServer) withScope(scope string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := "anonymous"
+		if h.auth != nil {
+			identity := h.auth.authenticate(r)
+			if identity == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="streamd"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if !identity.hasScope(scope) {
+				klog.Warningf("audit: %s denied %s %s from %s: missing scope '%s'", identity.name, r.Method, r.URL, r.RemoteAddr, scope)
+				http.Error(w, fmt.Sprintf("forbidden: missing scope '%s'", scope), http.StatusForbidden)
+				return
+			}
+			name = identity.name
+			r = r.WithContext(context.WithValue(r.Context(), authIdentityKey{}, identity))
+		}
+
+		if scope != scopeControl {
+			handler(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+		klog.Infof("audit: %s %s %s from %s: %d", name, r.Method, r.URL, r.RemoteAddr, rec.status)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is self-contained and does not load anything from external
+// servers, as the edge servers are not necessarily connected to the internet.
+//
+//go:embed web
+var webFS embed.FS
+
+func (h *httpServer) setupDashboardHandlers() {
+	web, err := fs.Sub(webFS, "web")
+	if err != nil {
+		// The embedded directory is known at compile time
+		panic(err)
+	}
+
+	http.Handle("/dashboard/", http.StripPrefix("/dashboard/", http.FileServerFS(web)))
+	http.Handle("/{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Matches path wildcards such as '{name}' or '{path...}'
+var pathWildcardRegexp = regexp.MustCompile(`\{([a-zA-Z0-9_]+)(\.\.\.)?\}`)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Derive a JSON schema from the type of a request or response body. Only the
+// subset of types used in the API is supported.
+func openAPISchema(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return openAPISchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": openAPISchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": openAPISchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = openAPISchema(f.Type)
+		}
+		return map[string]any{"type": "object", "properties": props}
+	default:
+		return map[string]any{}
+	}
+}
+
+func openAPIJSONContent(v any) map[string]any {
+	return map[string]any{
+		"application/json": map[string]any{
+			"schema": openAPISchema(reflect.TypeOf(v)),
+		},
+	}
+}
+
+// Generate an OpenAPI 3 description of the API from its route table
+func newOpenAPISpec(routes []apiRoute) map[string]any {
+	paths := map[string]any{}
+	for _, route := range routes {
+		op := map[string]any{
+			"summary":  route.summary,
+			"security": []any{map[string]any{"bearerAuth": []string{route.scope}}},
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "OK",
+					"content":     openAPIJSONContent(route.response),
+				},
+				"default": map[string]any{
+					"description": "Error",
+					"content":     openAPIJSONContent(apiErrorResponse{}),
+				},
+			},
+		}
+
+		params := []any{}
+		for _, m := range pathWildcardRegexp.FindAllStringSubmatch(route.path, -1) {
+			params = append(params, map[string]any{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]any{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+
+		if route.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  openAPIJSONContent(route.request),
+			}
+		}
+
+		// OpenAPI does not know about catch-all wildcards
+		path := pathWildcardRegexp.ReplaceAllString(apiPrefix+route.path, "{$1}")
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(route.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "streamd",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Token from the file passed via -http-tokens. Routes list the required scope.",
+				},
+			},
+		},
+	}
+}
+
+// Serve the OpenAPI description generated from the route table
+func openAPIHandler(routes []apiRoute) http.HandlerFunc {
+	spec := newOpenAPISpec(routes)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, spec)
+	}
+}
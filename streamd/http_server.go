@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpReadTimeout       = 15 * time.Second
+	// rendering the filter graph may take a few seconds
+	httpWriteTimeout    = 30 * time.Second
+	httpIdleTimeout     = 120 * time.Second
+	httpShutdownTimeout = 5 * time.Second
+
+	// minimum time between checks for a renewed certificate
+	certReloadInterval = 10 * time.Second
+)
+
+// certReloader serves the TLS certificate from certFile and keyFile and
+// reloads it when one of the files changes, e.g. after a renewal.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	// mu guards the fields below.
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Load the certificate if the files have been modified since the last load.
+// c.mu must be held.
+func (c *certReloader) reload() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		klog.Infof("reloaded TLS certificate from %s", c.certFile)
+	}
+
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.lastCheck) >= certReloadInterval {
+		c.lastCheck = time.Now()
+		// Keep serving the old certificate if the new one is incomplete,
+		// e.g. when only the certificate has been written so far.
+		if err := c.reload(); err != nil {
+			klog.Warningf("failed to reload TLS certificate: %v", err)
+		}
+	}
+
+	return c.cert, nil
+}
+
+// Build the TLS configuration of the HTTP server. Returns nil if TLS is
+// disabled.
+func newHTTPTLSConfig(c *daemonConfig) (*tls.Config, error) {
+	if c.httpTLSCert == "" && c.httpTLSKey == "" {
+		if c.httpClientCA != "" {
+			return nil, errors.New("-http-client-ca requires -http-tls-cert and -http-tls-key")
+		}
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(c.httpTLSCert, c.httpTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if c.httpClientCA != "" {
+		pem, err := os.ReadFile(c.httpClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.httpClientCA)
+		}
+		// Bearer tokens remain usable for clients without a certificate
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// Bind the HTTP server and serve handler in the background until
+// stopHTTPServer is called. Returns an error if the address cannot be bound,
+// as the daemon is not controllable without its HTTP server.
+func startHTTPServer(handler http.Handler, c *daemonConfig) (*http.Server, error) {
+	tlsConfig, err := newHTTPTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("%s:%s", c.listenAddr, c.listenHTTP),
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	klog.Infof("listening for HTTP at %s (TLS: %t)", srv.Addr, tlsConfig != nil)
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			klog.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+
+	return srv, nil
+}
+
+// Stop accepting connections and wait for active requests to complete
+func stopHTTPServer(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		klog.Warningf("HTTP server shutdown: %v", err)
+	}
+}
@@ -2,24 +2,48 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"maps"
 	"net"
-	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-gst/go-glib/glib"
 	"github.com/go-gst/go-gst/gst"
 	"k8s.io/klog"
 )
 
+// Exit codes of the daemon
+const (
+	exitOK = 0
+	// the pipeline could not be constructed or reached EOS without a shutdown
+	// request
+	exitFailure = 1
+	// the pipeline did not drain within the shutdown timeout. Outputs may not
+	// be finalised.
+	exitShutdownTimeout = 3
+)
+
 // daemonConfig contains all configurable parameters
 type daemonConfig struct {
 	listenHTTP string
 
+	// file containing bearer tokens and their scopes. Authentication is
+	// disabled if empty.
+	httpTokensFile string
+	// certificate and key for serving HTTPS. Plain HTTP is served if empty.
+	httpTLSCert string
+	httpTLSKey  string
+	// CA certificates used to verify client certificates (mTLS)
+	httpClientCA string
+
 	// cidr containing ip to listen on
 	listenCidr string
 	// srt listening port for combined stream
@@ -28,6 +52,10 @@ type daemonConfig struct {
 	presPort string
 	// srt listening port for camera stream
 	camPort string
+	// srt listening port for multiview stream
+	multiviewPort string
+	// srt listening port for audio-only stream
+	audioPort string
 
 	// ip to listen on
 	listenAddr string
@@ -45,13 +73,102 @@ type daemonConfig struct {
 	// the GStreamer properties for the master audio source element
 	sourceAudioOpts string
 
+	// formats of the video sources by source name (camera, present).
+	// Defaults to defaultVideoFormat.
+	sourceFormats map[string]videoCapsFilter
+	// formats of the video outputs by output name (combined, present,
+	// camera). The presentation and camera outputs default to the format of
+	// their source.
+	outputFormats map[string]videoCapsFilter
+	// deinterlacing and colour space handling of Decklink video sources by
+	// source name (camera, present). Defaults to defaultVideoSourceSettings.
+	videoSourceSettings map[string]videoSourceSettings
+
 	videoEncBitrateKbps int
 	audioEncBitrateKbps int
 
 	audioAmplification float64
+	// optional processing chain of the audio source given by -source-audio
+	audioProcessing audioProcessing
+
+	// offsets of the timestamps of sources by source name
+	avOffsets map[string]time.Duration
+	// whether test sources show a flash and beep to measure A/V offsets
+	avSyncTest bool
+
+	// inputs of the audio mixer. Defaults to the source given by -source-audio.
+	audioInputs []audioInputConfig
+	// distribute the channels of inputs to new inputs, applied by
+	// resolveAudioConfig
+	audioChannelMaps []audioChannelMap
+	// '<name>:<settings>' of the inputs, applied by resolveAudioConfig
+	audioInputSettings []string
+	// mixes of the inputs. Defaults to a single mix of all inputs.
+	audioMixes []audioMixConfig
+	// key is the name of the output, value the names of the mixes carried as
+	// audio tracks
+	audioRoutes map[string][]string
+	// key is the name of the mix, value its ISO 639-2 language code
+	audioLanguages map[string]string
+
+	// an audio source is reported silent if its RMS level stays below
+	// audioSilenceThresholdDB (dBFS) for audioSilenceDuration. 0 disables
+	// the detection.
+	audioSilenceThresholdDB float64
+	audioSilenceDuration    time.Duration
+	// an audio source is reported clipping if its peak level stays at or
+	// above audioClippingThresholdDB (dBFS) for audioClippingDuration. 0
+	// disables the detection.
+	audioClippingThresholdDB float64
+	audioClippingDuration    time.Duration
+	// URL to which audio alerts are posted as JSON. Disabled if empty.
+	audioAlertWebhook string
 
 	// whether to enable hardware acceleration in the filter graph
 	hwAccel bool
+
+	// maximum time to wait for EOS to propagate through the pipeline on shutdown
+	shutdownTimeout time.Duration
+
+	// directory to which filter graphs are written on every state change.
+	// Graphs are only kept in memory if empty.
+	graphHistoryDir string
+
+	// whether to enable the latency, proctime, and queuelevel tracers
+	tracers bool
+
+	// file in which changes made at runtime are persisted. Changes are lost
+	// on restart if empty.
+	stateFile string
+
+	// whether to add a low-resolution multiview of all inputs as an additional output
+	multiview               bool
+	multiviewEncBitrateKbps int
+	// directory to which the multiview is written as HLS. Disabled if empty.
+	multiviewHLSDir string
+
+	// whether to add an audio-only output via SRT
+	audioOutput bool
+	// Icecast mount to which the audio-only output is streamed. nil if
+	// disabled.
+	audioOutputIcecast *icecastConfig
+}
+
+// Returns the URI of an SRT listener on port
+func (c *daemonConfig) srtURI(port string) string {
+	return fmt.Sprintf("srt://%s:%s?mode=listener", c.listenAddr, port)
+}
+
+// Returns the URI of the SRT listener of an output
+func (c *daemonConfig) outputSRTURI(output string) string {
+	ports := map[string]string{
+		"combined":  c.combPort,
+		"present":   c.presPort,
+		"camera":    c.camPort,
+		"multiview": c.multiviewPort,
+		"audio":     c.audioPort,
+	}
+	return c.srtURI(ports[output])
 }
 
 // daemon is the main service of streamd
@@ -60,6 +177,17 @@ type daemon struct {
 	// mu guards the state below.
 	mu sync.RWMutex
 	daemonState
+
+	// liveness of the main loop and metrics goroutine for the systemd watchdog
+	mainloopHeartbeat heartbeat
+	metricsHeartbeat  heartbeat
+	// whether READY=1 has been sent to systemd
+	notifiedReady atomic.Bool
+	// nil unless tracers are enabled. Set before the metrics goroutine is
+	// started.
+	tracer *tracerStats
+	// changes made at runtime. Set before the HTTP server is started.
+	state *stateStore
 }
 
 // daemonState contains all the state of the daemon
@@ -67,67 +195,166 @@ type daemonState struct {
 	pipeline *pipeline
 	mainloop *glib.MainLoop
 	metrics  metrics
+	graphs   *graphHistory
+
+	// set when a shutdown has been requested by a signal
+	shuttingDown bool
+	// set by the bus watch once EOS has reached all sinks
+	eosReceived bool
 }
 
+// Returned by control actions until the pipeline is constructed. The HTTP
+// server is started before.
+var errPipelineNotConstructed = errors.New("pipeline not constructed")
+
 // daemonController provides a MT-safe interface for other
 // parts of the application (e.g. HTTP server or metrics collector)
 type daemonController interface {
 	metricsSnapshot() metrics
 	graph(details gst.DebugGraphDetails) string
-	srtStatistics() ([]*srtStats, error)
+	graphHistory() []graphSnapshot
+	graphFromHistory(id uint64) (graphSnapshot, bool)
+	srtStatistics() ([]outputSRTStats, error)
+	snapshot(source string) (snapshot, error)
+	config() daemonConfig
+	sources() []sourceInfo
+	health() healthReport
+	readiness() healthReport
+	setSourceOffset(source string, offset time.Duration) error
+	updateAudioInput(name string, u audioInputUpdate) (audioInputState, error)
 }
 
-func (d *daemon) srtStatistics() ([]*srtStats, error) {
+func (d *daemon) srtStatistics() ([]outputSRTStats, error) {
 	d.mu.Lock()
-	combBin := d.pipeline.srtCompositorSink
-	presentBin := d.pipeline.srtPresentSink
-	camBin := d.pipeline.srtCamSink
+	outputs := d.pipeline.outputBins()
 	d.mu.Unlock()
 
-	combStats, err := getSRTStatistics(combBin)
-	if err != nil {
-		return nil, err
-	}
-	presentStats, err := getSRTStatistics(presentBin)
-	if err != nil {
-		return nil, err
+	var stats []outputSRTStats
+	for _, output := range outputs {
+		if output.srtSink == nil {
+			continue
+		}
+		s, err := getSRTStatistics(output.srtSink)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, outputSRTStats{output.name, *s})
 	}
-	camStats, err := getSRTStatistics(camBin)
-	if err != nil {
-		return nil, err
+	return stats, nil
+}
+
+// get the configuration of the daemon. The configuration is immutable after
+// startup.
+func (d *daemon) config() daemonConfig {
+	return d.daemonConfig
+}
+
+// get the configuration and the negotiated caps of all sources
+func (d *daemon) sources() []sourceInfo {
+	d.mu.RLock()
+	p := d.pipeline
+	d.mu.RUnlock()
+	if p == nil {
+		return nil
 	}
 
-	return []*srtStats{combStats, presentStats, camStats}, nil
+	sources := []sourceInfo{
+		newSourceInfo(sourceCamera, sourceKindVideo, d.sourceCam, d.sourceCamOpts, p.camSrcCaps.string(), p.camSrc),
+		newSourceInfo(sourcePresent, sourceKindVideo, d.sourcePresent, d.sourcePresentOpts, p.presentSrcCaps.string(), p.presentSrc),
+	}
+	for i := range sources {
+		sources[i].probe = p.sourceProbes[sources[i].name]
+	}
+	if d.sourceCam == "decklinkvideosrc" {
+		sources[0].captureCaps = decklinkCaps(p.camSrc)
+	}
+	if d.sourcePresent == "decklinkvideosrc" {
+		sources[1].captureCaps = decklinkCaps(p.presentSrc)
+	}
+	for _, in := range p.audioInputs {
+		caps := p.audioInputCaps(in.config)
+		sources = append(sources, newSourceInfo(in.config.name, sourceKindAudio, in.config.factory, in.config.opts, caps.string(), in.src))
+	}
+	return sources
 }
 
 // get a snapshot of the current metrics
 func (d *daemon) metricsSnapshot() metrics {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	return d.metrics
+
+	// Maps are updated in place by the bus watch
+	m := d.metrics
+	m.pipelineStats.qosEvents = maps.Clone(d.metrics.pipelineStats.qosEvents)
+	m.pipelineStats.lastWarnings = maps.Clone(d.metrics.pipelineStats.lastWarnings)
+	m.audio = maps.Clone(d.metrics.audio)
+	return m
+}
+
+// get a recent JPEG frame of a source or the compositor output. Blocks until
+// the next frame is captured if the last one is outdated.
+func (d *daemon) snapshot(source string) (snapshot, error) {
+	d.mu.RLock()
+	p := d.pipeline
+	d.mu.RUnlock()
+	if p == nil {
+		return snapshot{}, errNoSnapshot
+	}
+	sink, ok := p.snapshots[source]
+	if !ok {
+		return snapshot{}, errUnknownSnapshotSource
+	}
+
+	return sink.capture()
 }
 
 // get the current filter graph as 'text/vnd.graphviz'
 func (d *daemon) graph(details gst.DebugGraphDetails) string {
 	d.mu.Lock()
-	p := d.pipeline.pipeline
+	p := d.pipeline
 	d.mu.Unlock()
+	if p == nil {
+		return ""
+	}
+
+	return redactSecrets(p.pipeline.DebugBinToDotData(details), d.graphSecrets())
+}
+
+// get the filter graphs recorded on state changes, oldest first
+func (d *daemon) graphHistory() []graphSnapshot {
+	return d.graphs.list()
+}
 
-	return p.DebugBinToDotData(details)
+// get a filter graph recorded on a state change
+func (d *daemon) graphFromHistory(id uint64) (graphSnapshot, bool) {
+	return d.graphs.get(id)
 }
 
 func (d *daemon) runPipeline() error {
+	if d.tracers {
+		enableTracers()
+	}
 	gst.Init(&os.Args)
+	if d.tracers {
+		d.tracer = newTracerStats()
+		d.tracer.installLogFunction()
+	}
 
-	var err error
-	d.pipeline, err = newPipeline(&d.daemonConfig)
+	pipeline, err := newPipeline(&d.daemonConfig)
 	if err != nil {
 		return err
 	}
 
-	p := d.pipeline.pipeline
-
+	// The HTTP server is already serving requests
+	d.mu.Lock()
+	d.pipeline = pipeline
 	d.metrics.pipelineStats = newPipelineStats()
+	d.metrics.audio = make(map[string]audioStats)
+	d.initAudioDSPStats()
+	d.mu.Unlock()
+
+	p := pipeline.pipeline
+
 	d.registerBusWatch()
 
 	// Start the pipeline
@@ -140,22 +367,126 @@ func main() {
 	d := &daemon{}
 
 	flag.StringVar(&d.listenHTTP, "http-port", "8080", "Port at which to listen for HTTP requests")
+	flag.StringVar(&d.httpTokensFile, "http-tokens", "", "File with bearer tokens and their scopes ('<name> <scope>[,<scope>...] <token>' per line). Enables authentication of the HTTP API")
+	flag.StringVar(&d.httpTLSCert, "http-tls-cert", "", "Certificate file for serving HTTPS")
+	flag.StringVar(&d.httpTLSKey, "http-tls-key", "", "Private key file for serving HTTPS")
+	flag.StringVar(&d.httpClientCA, "http-client-ca", "", "CA certificates for verifying HTTPS client certificates. The certificate Common Name is mapped to the token name")
 	flag.StringVar(&d.listenCidr, "listen-cidr", "", "CIDR containing Address to listen for all srt requests. E.g. 100.64.0.0/10 for tailnets. If unset, [::] will be listened on.")
 	flag.StringVar(&d.combPort, "port-comb-srt", "7000", "SRT listing port for combined stream")
 	flag.StringVar(&d.presPort, "port-present-srt", "7001", "SRT listing port for presentation stream")
 	flag.StringVar(&d.camPort, "port-cam-srt", "7002", "SRT listing port for camera stream")
+	flag.StringVar(&d.multiviewPort, "port-multiview-srt", "7003", "SRT listing port for multiview stream")
+	flag.StringVar(&d.audioPort, "port-audio-srt", "7004", "SRT listing port for audio-only stream")
 	flag.StringVar(&d.sourcePresent, "source-present", "videotestsrc", "GStreamer element factory name for the presentation source")
 	flag.StringVar(&d.sourcePresentOpts, "source-present-opts", "", "GStreamer element properties for presentation source")
 	flag.StringVar(&d.sourceCam, "source-cam", "videotestsrc", "GStreamer element factory name for the camera source")
 	flag.StringVar(&d.sourceCamOpts, "source-cam-opts", "", "GStreamer element properties for camera source")
 	flag.StringVar(&d.sourceAudio, "source-audio", "audiotestsrc", "GStreamer element factory name for the audio source")
 	flag.StringVar(&d.sourceAudioOpts, "source-audio-opts", "", "GStreamer element properties for audio source")
+	d.sourceFormats = make(map[string]videoCapsFilter)
+	flag.Func("source-format", "Video format of a source (camera, present) as '<source>:<width>x<height>p<fps>[/<denominator>]', e.g. 'camera:1280x720p50'. May be repeated. Defaults to 1920x1080p30", func(s string) error {
+		return parseNamedVideoFormat(d.sourceFormats, []string{sourceCamera, sourcePresent}, s)
+	})
+	d.videoSourceSettings = make(map[string]videoSourceSettings)
+	flag.Func("source-video-settings", "Deinterlacing and colour space of a Decklink video source (camera, present) as '<source>:<setting>[,<setting>...]', e.g. 'camera:deinterlace=on,field-order=tff,colorimetry=bt709,range=limited'. May be repeated", func(s string) error {
+		return parseVideoSourceSettings(d.videoSourceSettings, s)
+	})
+	d.outputFormats = make(map[string]videoCapsFilter)
+	flag.Func("output-format", "Video format of an output (combined, present, camera) as '<output>:<width>x<height>p<fps>[/<denominator>]', e.g. 'combined:3840x2160p25'. May be repeated. The combined output defaults to 1920x1080p30, the others to the format of their source", func(s string) error {
+		return parseNamedVideoFormat(d.outputFormats, []string{outputCombined, outputPresent, outputCamera}, s)
+	})
 	flag.IntVar(&d.videoEncBitrateKbps, "video-enc-bitrate", 6000, "Video encoding bitrate in Kbps")
 	flag.IntVar(&d.audioEncBitrateKbps, "audio-enc-bitrate", 96, "Video encoding bitrate in Kbps")
 	flag.Float64Var(&d.audioAmplification, "audio-amplification", 1.0, "Audio amplifcation after conversion")
+	flag.Func("audio-input", "Input of the audio mixer as '<name>:<factory>[:<properties>]', e.g. 'mic:alsasrc:device=hw:1'. May be repeated. Replaces -source-audio", func(s string) error {
+		in, err := parseAudioInput(s)
+		if err != nil {
+			return err
+		}
+		d.audioInputs = append(d.audioInputs, in)
+		return nil
+	})
+	flag.Func("audio-channel-map", "Channels of an audio input with the given number of channels mapped to new inputs as '<input>:<channels>:<name>=<channel>[+<channel>][,...]', e.g. 'deck:16:mic=3,hdmi=5+6'. Unmapped channels are discarded. May be repeated", func(s string) error {
+		m, err := parseAudioChannelMap(s)
+		if err != nil {
+			return err
+		}
+		d.audioChannelMaps = append(d.audioChannelMaps, m)
+		return nil
+	})
+	flag.Func("audio-input-settings", "Gain, pan, mute, and processing of an audio input as '<name>:<setting>[,<setting>...]', e.g. 'mic:gain=-6,pan=-0.5,highpass=80'. May be repeated", func(s string) error {
+		d.audioInputSettings = append(d.audioInputSettings, s)
+		return nil
+	})
+	flag.Func("audio-mix", "Mix of audio inputs as '<name>:<input>[,<input>...]'. May be repeated. Defaults to a single mix 'master' of all inputs", func(s string) error {
+		mix, err := parseAudioMix(s)
+		if err != nil {
+			return err
+		}
+		d.audioMixes = append(d.audioMixes, mix)
+		return nil
+	})
+	d.audioRoutes = make(map[string][]string)
+	flag.Func("audio-route", "Route of audio mixes to an output (combined, present, camera, multiview, audio) as '<output>:<mix>[,<mix>...]'. Every mix is carried as an audio track. May be repeated. Outputs without a route receive the first mix", func(s string) error {
+		return parseAudioRoute(d.audioRoutes, s)
+	})
+	d.audioLanguages = make(map[string]string)
+	flag.Func("audio-language", "ISO 639-2 language code of the audio tracks of a mix as '<mix>:<language>', e.g. 'interpreter:eng'. May be repeated", func(s string) error {
+		return parseAudioLanguage(d.audioLanguages, s)
+	})
+	audioProcessingSpec := flag.String("audio-processing", "", "Processing chain of the audio source, e.g. 'denoise,highpass=80,gate=-50,compressor=-18:4,limiter,loudness=-23'")
+	d.avOffsets = make(map[string]time.Duration)
+	flag.Func("av-offset", "A/V offset of a source (camera, present, or an audio input) as '<source>:<ms>'. A positive offset delays the source. May be repeated", func(s string) error {
+		return parseAVOffset(d.avOffsets, s)
+	})
+	flag.BoolVar(&d.avSyncTest, "av-sync-test", false, "Replace the patterns of test sources with a flash and a beep every second to measure A/V offsets")
+	flag.Float64Var(&d.audioSilenceThresholdDB, "audio-silence-threshold", -60, "RMS level in dBFS below which an audio source is considered silent")
+	flag.DurationVar(&d.audioSilenceDuration, "audio-silence-duration", 10*time.Second, "Duration of silence after which an alert is raised. 0 disables silence detection")
+	flag.Float64Var(&d.audioClippingThresholdDB, "audio-clipping-threshold", -1, "Peak level in dBFS at or above which an audio source is considered clipping")
+	flag.DurationVar(&d.audioClippingDuration, "audio-clipping-duration", 2*time.Second, "Duration of clipping after which an alert is raised. 0 disables clipping detection")
+	flag.StringVar(&d.audioAlertWebhook, "audio-alert-webhook", "", "URL to which silence and clipping alerts are posted as JSON")
 	flag.BoolVar(&d.hwAccel, "hw-accel", false, "Enable hardware acceleration and offload processing tasks onto the GPU or a DSP")
+	flag.DurationVar(&d.shutdownTimeout, "shutdown-timeout", 5*time.Second, "Maximum time to wait for outputs to be finalised on SIGINT or SIGTERM")
+	flag.StringVar(&d.graphHistoryDir, "graph-history-dir", "", "Directory to which the filter graph is written on every pipeline state change and on errors")
+	flag.StringVar(&d.stateFile, "state-file", defaultStateFile(), "File in which changes made at runtime, e.g. the mute and gain of audio inputs, are persisted across restarts. Defaults to state.json in $STATE_DIRECTORY. Empty to not persist changes")
+	flag.BoolVar(&d.tracers, "tracers", false, "Enable the GStreamer latency, proctime, and queuelevel tracers and export per-element processing times and queue levels as metrics")
+	flag.BoolVar(&d.multiview, "multiview", false, "Enable the multiview output showing all inputs, audio meters, and a clock")
+	flag.IntVar(&d.multiviewEncBitrateKbps, "multiview-enc-bitrate", 1500, "Multiview video encoding bitrate in Kbps")
+	flag.StringVar(&d.multiviewHLSDir, "multiview-hls-dir", "", "Directory to which the multiview is additionally written as HLS, served at /hls/multiview/playlist.m3u8. Requires -multiview")
+	flag.BoolVar(&d.audioOutput, "audio-output", false, "Enable the audio-only output as AAC in MPEG-TS via SRT")
+	flag.Func("audio-output-icecast", "Stream the audio-only output to an Icecast mount given as 'icecast://[<user>@]<host>[:<port>]/<mount>'. Mounts ending in '.mp3' are encoded to MP3, all others to Opus in Ogg", func(s string) error {
+		var err error
+		d.audioOutputIcecast, err = parseIcecastURL(s)
+		return err
+	})
+	icecastPasswordFile := flag.String("audio-output-icecast-password-file", "", "File containing the password of the Icecast mount. Defaults to $STREAMD_ICECAST_PASSWORD")
 	flag.Parse()
 
+	var err error
+	d.audioProcessing, err = parseAudioProcessing(*audioProcessingSpec)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	if err := d.resolveAudioConfig(); err != nil {
+		klog.Fatal(err)
+	}
+	if err := d.resolveVideoSourceSettings(); err != nil {
+		klog.Fatal(err)
+	}
+	if d.multiviewHLSDir != "" && !d.multiview {
+		klog.Fatal("-multiview-hls-dir requires -multiview")
+	}
+	if d.audioOutputIcecast != nil {
+		if err := d.audioOutputIcecast.loadPassword(*icecastPasswordFile); err != nil {
+			klog.Fatal(err)
+		}
+	}
+	d.state, err = loadStateStore(d.stateFile)
+	if err != nil {
+		klog.Fatalf("failed to load state: %v", err)
+	}
+	d.applyPersistedAudioState(d.state)
+
 	if d.listenCidr != "" {
 		_, cidr, err := net.ParseCIDR(d.listenCidr)
 		if err != nil {
@@ -174,32 +505,117 @@ func main() {
 	}
 
 	d.mainloop = glib.NewMainLoop(glib.MainContextDefault(), false)
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
+	d.startMainloopHeartbeat()
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := <-sigs
+		klog.Infof("received %s", sig)
+		cancel()
+	}()
 
 	// Create and start HTTP server
-	h := &httpServer{d}
+	h := &httpServer{daemonController: d}
+	if d.httpTokensFile != "" {
+		auth, err := loadAuthenticator(d.httpTokensFile)
+		if err != nil {
+			klog.Fatalf("failed to load HTTP tokens: %v", err)
+		}
+		h.auth = auth
+	} else {
+		klog.Warning("HTTP authentication is disabled. Use -http-tokens to enable it.")
+	}
+	if d.httpClientCA != "" && h.auth == nil {
+		klog.Fatal("-http-client-ca requires -http-tokens to map client certificates to scopes")
+	}
 	h.setupHTTPHandlers()
 
-	klog.Infof("listening for HTTP at %s:%s", d.listenAddr, d.listenHTTP)
-	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%s", d.listenAddr, d.listenHTTP), nil); err != nil {
-			klog.Errorf("HTTP listen failed: %v", err)
-		}
-	}()
+	// Served by the HTTP server before the pipeline is constructed
+	d.graphs = newGraphHistory(d.graphHistoryDir, d.graphSecrets())
+	srv, err := startHTTPServer(nil, &d.daemonConfig)
+	if err != nil {
+		klog.Fatalf("failed to start HTTP server: %v", err)
+	}
 
 	if err := d.runPipeline(); err != nil {
 		klog.Errorf("Failed to start pipeline: %v", err)
+		os.Exit(exitFailure)
 	}
 
+	// The HTTP server, the metrics, and the watchdog keep running while the
+	// outputs are finalised and are stopped with the pipeline
+	serveCtx, stopServing := context.WithCancel(context.Background())
+
 	// floating around and move outside runPipeline
-	go d.metricsProcess(ctx)
+	go d.metricsProcess(serveCtx)
+	go d.watchdogProcess(serveCtx)
 
 	go func() {
 		<-ctx.Done() // Wait until the context is cancelled
-		// When the context is cancelled, break out of the main loop
+		d.shutdown()
+
+		// A second signal skips draining the pipeline
+		<-sigs
+		klog.Warning("received second signal, quitting without waiting for EOS")
 		d.mainloop.Quit()
 	}()
 	d.mainloop.Run()
+
+	code := d.stopPipeline()
+	stopServing()
+	stopHTTPServer(srv)
+	klog.Flush()
+	os.Exit(code)
+}
+
+// Send EOS through the pipeline so that muxers finalise their outputs. The
+// bus watch quits the main loop once EOS reached all sinks. If this does not
+// happen within the shutdown timeout, the main loop is quit regardless.
+func (d *daemon) shutdown() {
+	d.mu.Lock()
+	d.shuttingDown = true
+	p := d.pipeline.pipeline
+	d.mu.Unlock()
+
+	klog.Infof("shutting down, waiting up to %s for EOS", d.shutdownTimeout)
+	_, err := sdNotify("STOPPING=1\nSTATUS=finalising outputs")
+	logNotifyError(err)
+	if !p.SendEvent(gst.NewEOSEvent()) {
+		klog.Warning("pipeline did not accept EOS event")
+		d.mainloop.Quit()
+		return
+	}
+
+	time.AfterFunc(d.shutdownTimeout, func() {
+		klog.Errorf("EOS did not reach all sinks within %s", d.shutdownTimeout)
+		d.mainloop.Quit()
+	})
+}
+
+// Set the pipeline to NULL after the main loop has quit and return the exit
+// code of the daemon.
+func (d *daemon) stopPipeline() int {
+	d.mu.Lock()
+	p := d.pipeline.pipeline
+	shuttingDown := d.shuttingDown
+	eosReceived := d.eosReceived
+	d.mu.Unlock()
+
+	if err := p.BlockSetState(gst.StateNull); err != nil {
+		klog.Errorf("failed to set pipeline to NULL: %v", err)
+	}
+
+	switch {
+	case shuttingDown && eosReceived:
+		klog.Info("pipeline drained, all outputs finalised")
+		return exitOK
+	case shuttingDown:
+		return exitShutdownTimeout
+	default:
+		klog.Error("pipeline reached EOS unexpectedly")
+		return exitFailure
+	}
 }
 
 // getIfaceIP returns the first IP address available on the system that is within cidr or an error if none is found.
@@ -2,53 +2,327 @@ package main
 
 import (
 	"context"
+	"math"
+	"strconv"
 	"time"
 
 	"bitbucket.org/bertimus9/systemstat"
+	"github.com/go-gst/go-gst/gst"
 	"k8s.io/klog"
 )
 
+// time between two samples of the metrics goroutine
+const metricsInterval = time.Second
+
+// outputSRTStats are the statistics of the srtsink of an output
+type outputSRTStats struct {
+	output string
+	stats  srtStats
+}
+
 type metrics struct {
-	compSinkStats    srtStats
-	presentSinkStats srtStats
-	camSinkStats     srtStats
-	pipelineStats    pipelineStats // Updated by bus watch on main thread
-	cpu              systemstat.CPUSample
-	mem              systemstat.MemSample
-	loadAvg          systemstat.LoadAvgSample
+	// in the order of the outputs of the pipeline
+	srtSinks      []outputSRTStats
+	pipelineStats pipelineStats // Updated by bus watch on main thread
+	cpu           systemstat.CPUSample
+	mem           systemstat.MemSample
+	loadAvg       systemstat.LoadAvgSample
+	branches      []branchSample
+	// key is the name of the source. Updated by bus watch on main thread
+	audio map[string]audioStats
+
+	// Aggregated tracer records. Empty unless -tracers is set.
+	elementProcTime map[string]*histogram
+	elementLatency  map[string]*histogram
+	queueLevels     map[string]queueLevel
 }
 
 func (d *daemon) metricsProcess(ctx context.Context) {
+	// previous sample of every branch for computing rates
+	prevBranches := make(map[string]branchSample)
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
+			d.metricsHeartbeat.beat()
+
 			cpu := systemstat.GetCPUSample()
 			mem := systemstat.GetMemSample()
 			loadAvg := systemstat.GetLoadAvgSample()
 
-			// []*srtStats{combStats, presentStats, camStats}
-			srtStats, err := d.srtStatistics()
+			srtSinks, err := d.srtStatistics()
 			if err != nil {
 				klog.Warningf("failed to retrieve statistics from srtsinks: %v", err)
+				time.Sleep(metricsInterval)
 				continue
 			}
 
-			srtCompStats := srtStats[0]
-			srtPresentStats := srtStats[1]
-			srtCamStats := srtStats[2]
+			branches := make([]branchSample, 0, len(d.pipeline.branches))
+			for _, b := range d.pipeline.branches {
+				var prev *branchSample
+				if s, ok := prevBranches[b.name]; ok {
+					prev = &s
+				}
+				s, err := b.sample(prev)
+				if err != nil {
+					klog.Warningf("failed to retrieve statistics of branch '%s': %v", b.name, err)
+				}
+				prevBranches[b.name] = s
+				branches = append(branches, s)
+			}
+
+			var procTime, latency map[string]*histogram
+			var queueLevels map[string]queueLevel
+			if d.tracer != nil {
+				procTime, latency, queueLevels = d.tracer.snapshot()
+			}
 
 			d.mu.Lock()
 			d.metrics.cpu = cpu
 			d.metrics.mem = mem
 			d.metrics.loadAvg = loadAvg
-			d.metrics.compSinkStats = *srtCompStats
-			d.metrics.presentSinkStats = *srtPresentStats
-			d.metrics.camSinkStats = *srtCamStats
+			d.metrics.srtSinks = srtSinks
+			d.metrics.branches = branches
+			d.metrics.elementProcTime = procTime
+			d.metrics.elementLatency = latency
+			d.metrics.queueLevels = queueLevels
 			d.mu.Unlock()
 
-			time.Sleep(time.Second * 1)
+			time.Sleep(metricsInterval)
+		}
+	}
+}
+
+// Returns the registry of all collectors exported on /metrics
+func newMetricsRegistry() *registry {
+	r := &registry{}
+	r.register(collectSystemMetrics)
+	r.register(collectSRTMetrics)
+	r.register(collectPipelineMetrics)
+	r.register(collectBranchMetrics)
+	r.register(collectAudioMetrics)
+	r.register(collectTracerMetrics)
+	return r
+}
+
+func collectSystemMetrics(m *metrics, s *familySet) {
+	/* CPU */
+
+	s.counter("linux_proc_user_total", "Time spent in user mode, in ticks").add(float64(m.cpu.User))
+	s.counter("linux_proc_system_total", "Time spent in system mode, in ticks").add(float64(m.cpu.System))
+	s.counter("linux_proc_iowait_total", "Time spent waiting for I/O to complete, in ticks").add(float64(m.cpu.Iowait))
+	s.counter("linux_proc_irq_total", "Time spent servicing interrupts, in ticks").add(float64(m.cpu.Irq))
+	s.counter("linux_proc_softirq_total", "Time spent servicing soft interrupts, in ticks").add(float64(m.cpu.SoftIrq))
+
+	/* Memory */
+
+	s.gauge("linux_mem_used_bytes", "Amount of memory used, in bytes").add(float64(m.mem.MemUsed * 1024))
+	s.gauge("linux_mem_free_bytes", "Amount of free memory, in bytes").add(float64(m.mem.MemFree * 1024))
+
+	/* TODO(hugo) I/O Status metrics via `iostat` when recording is implemented */
+
+	/* Load Average */
+
+	s.gauge("load_avg_one", "Load average over one minute").add(m.loadAvg.One)
+	s.gauge("load_avg_five", "Load average over five minutes").add(m.loadAvg.Five)
+	s.gauge("load_avg_fifteen", "Load average over fifteen minutes").add(m.loadAvg.Fifteen)
+}
+
+func collectSRTMetrics(m *metrics, s *familySet) {
+	callers := s.gauge("srt_callers", "Current number of subscribers to the SRT stream")
+	sendBytes := s.counter("srt_send_bytes_total", "Total bytes sent across all callers")
+
+	// Per caller statistics
+	gauges := []struct {
+		f     *metricFamily
+		value func(c *srtCallerStats) float64
+	}{
+		{s.gauge("srt_send_rate", "Send rate in Mbps"), func(c *srtCallerStats) float64 { return c.sendRateMbps }},
+		{s.gauge("srt_receive_rate", "Receive rate in Mbps"), func(c *srtCallerStats) float64 { return c.receiveRateMbps }},
+		{s.gauge("srt_bandwidth", "Bandwidth in Mbps"), func(c *srtCallerStats) float64 { return c.bandwidthMbps }},
+		{s.gauge("srt_rtt_seconds", "RTT in s"), func(c *srtCallerStats) float64 { return c.rttMS / 1000 }},
+		{s.gauge("srt_negotiated_latency_seconds", "Negotiated latency in s"), func(c *srtCallerStats) float64 { return float64(c.negotiatedLatencyMS) / 1000 }},
+	}
+	counters := []struct {
+		f     *metricFamily
+		value func(c *srtCallerStats) float64
+	}{
+		{s.counter("srt_send_duration_seconds_total", "Total time spent sending"), func(c *srtCallerStats) float64 { return float64(c.sendDurationUs) / 1e6 }},
+		{s.counter("srt_sent_bytes_total", "Total bytes sent"), func(c *srtCallerStats) float64 { return float64(c.bytesSent) }},
+		{s.counter("srt_retransmitted_bytes_total", "Total bytes retransmitted"), func(c *srtCallerStats) float64 { return float64(c.bytesRetransmitted) }},
+		{s.counter("srt_sent_dropped_bytes_total", "Total bytes dropped by the sender"), func(c *srtCallerStats) float64 { return float64(c.bytesSentDropped) }},
+		{s.counter("srt_received_bytes_total", "Total bytes received"), func(c *srtCallerStats) float64 { return float64(c.bytesReceived) }},
+		{s.counter("srt_received_lost_bytes_total", "Total bytes lost while receiving"), func(c *srtCallerStats) float64 { return float64(c.bytesReceivedLost) }},
+		{s.counter("srt_packets_sent_total", "Total packets sent"), func(c *srtCallerStats) float64 { return float64(c.packetsSent) }},
+		{s.counter("srt_packets_sent_lost_total", "Total packets lost"), func(c *srtCallerStats) float64 { return float64(c.packetsSentLost) }},
+		{s.counter("srt_packets_sent_dropped_total", "Total packets dropped"), func(c *srtCallerStats) float64 { return float64(c.packetsSentDropped) }},
+		{s.counter("srt_packets_retransmitted_total", "Total packets retransmitted"), func(c *srtCallerStats) float64 { return float64(c.packetsRetransmitted) }},
+		{s.counter("srt_packets_ack_received_total", "Number of acks received"), func(c *srtCallerStats) float64 { return float64(c.packetAckReceived) }},
+		{s.counter("srt_packets_nack_received_total", "Number of nacks received"), func(c *srtCallerStats) float64 { return float64(c.packetNackReceived) }},
+		{s.counter("srt_packets_received_total", "Total packets received"), func(c *srtCallerStats) float64 { return float64(c.packetsReceived) }},
+		{s.counter("srt_packets_received_lost_total", "Total packets lost while receiving"), func(c *srtCallerStats) float64 { return float64(c.packetsReceivedLost) }},
+		{s.counter("srt_packets_received_retransmitted_total", "Total retransmitted packets received"), func(c *srtCallerStats) float64 { return float64(c.packetsReceivedRetransmitted) }},
+		{s.counter("srt_packets_received_dropped_total", "Total packets dropped by the receiver"), func(c *srtCallerStats) float64 { return float64(c.packetReceivedDropped) }},
+		{s.counter("srt_packets_ack_sent_total", "Number of acks sent"), func(c *srtCallerStats) float64 { return float64(c.packetAckSent) }},
+		{s.counter("srt_packets_nack_sent_total", "Number of nacks sent"), func(c *srtCallerStats) float64 { return float64(c.packetNackSent) }},
+	}
+
+	for _, sink := range m.srtSinks {
+		callers.add(float64(len(sink.stats.callers)), "sink", sink.output)
+		sendBytes.add(float64(sink.stats.bytesSendTotal), "sink", sink.output)
+
+		for i := range sink.stats.callers {
+			c := &sink.stats.callers[i]
+			labels := []string{
+				"sink", sink.output,
+				"address", c.callerAddress.String(),
+				"port", strconv.Itoa(int(c.callerPort)),
+			}
+			for _, g := range gauges {
+				g.f.add(g.value(c), labels...)
+			}
+			for _, ctr := range counters {
+				ctr.f.add(ctr.value(c), labels...)
+			}
+		}
+	}
+}
+
+// Pipeline states exported as an enum
+var pipelineStates = []gst.State{gst.VoidPending, gst.StateNull, gst.StateReady, gst.StatePaused, gst.StatePlaying}
+
+func collectPipelineMetrics(m *metrics, s *familySet) {
+	state := s.gauge("gst_pipeline_state", "Current state of the pipeline. 1 for the current state, 0 otherwise")
+	for _, st := range pipelineStates {
+		state.add(boolToFloat(st == m.pipelineStats.state), "state", st.String())
+	}
+
+	s.counter("gst_warnings_total", "Number of warning messages posted on the pipeline bus").add(float64(m.pipelineStats.warnings))
+
+	lastWarning := s.gauge("gst_last_warning_timestamp_seconds", "Time of the last warning message posted by an element")
+	for element, t := range m.pipelineStats.lastWarnings {
+		lastWarning.add(float64(t.UnixMilli())/1000, "element", element)
+	}
+
+	qos := s.counter("gst_qos_events_total", "Number of qos events")
+	for element, v := range m.pipelineStats.qosEvents {
+		qos.add(float64(v), "element", element)
+	}
+
+	s.gauge("gst_pipeline_min_latency_seconds", "Minimum latency of the pipeline").add(m.pipelineStats.minLatency.Seconds())
+	maxLatency := math.Inf(1)
+	if m.pipelineStats.maxLatency >= 0 {
+		maxLatency = m.pipelineStats.maxLatency.Seconds()
+	}
+	s.gauge("gst_pipeline_max_latency_seconds", "Maximum latency of the pipeline, +Inf if unbounded").add(maxLatency)
+	s.gauge("gst_pipeline_configured_latency_seconds", "Latency configured on the pipeline, 0 if unset").add(m.pipelineStats.configuredLatency.Seconds())
+}
+
+func collectTracerMetrics(m *metrics, s *familySet) {
+	procTime := s.histogram("gst_element_processing_time_seconds", "Time a buffer takes to pass through an element")
+	for element, h := range m.elementProcTime {
+		procTime.addHistogram(h, "element", element)
+	}
+
+	latency := s.histogram("gst_element_latency_seconds", "Time a buffer takes from the source pad of the previous element to the source pad of an element")
+	for element, h := range m.elementLatency {
+		latency.addHistogram(h, "element", element)
+	}
+
+	levels := []struct {
+		f     *metricFamily
+		value func(l *queueLevel) float64
+	}{
+		{s.gauge("gst_queue_level_bytes", "Current fill level of a queue in bytes"), func(l *queueLevel) float64 { return float64(l.bytes) }},
+		{s.gauge("gst_queue_max_level_bytes", "Maximum fill level of a queue in bytes"), func(l *queueLevel) float64 { return float64(l.maxBytes) }},
+		{s.gauge("gst_queue_level_buffers", "Current fill level of a queue in buffers"), func(l *queueLevel) float64 { return float64(l.buffers) }},
+		{s.gauge("gst_queue_max_level_buffers", "Maximum fill level of a queue in buffers"), func(l *queueLevel) float64 { return float64(l.maxBuffers) }},
+		{s.gauge("gst_queue_level_seconds", "Current fill level of a queue in s"), func(l *queueLevel) float64 { return l.time.Seconds() }},
+		{s.gauge("gst_queue_max_level_seconds", "Maximum fill level of a queue in s"), func(l *queueLevel) float64 { return l.maxTime.Seconds() }},
+	}
+	for queue, l := range m.queueLevels {
+		for _, level := range levels {
+			level.f.add(level.value(&l), "queue", queue)
+		}
+	}
+}
+
+func collectBranchMetrics(m *metrics, s *familySet) {
+	frames := s.counter("gst_branch_frames_total", "Number of frames that left a branch")
+	bytes := s.counter("gst_branch_bytes_total", "Number of bytes that left a branch")
+	fps := s.gauge("gst_branch_fps", "Measured frames per second of a branch")
+	bitrate := s.gauge("gst_branch_bitrate_kbps", "Measured bitrate of a branch in Kbps")
+	keyframes := s.counter("gst_branch_keyframes_total", "Number of keyframes produced by an encoder")
+	keyframeInterval := s.gauge("gst_branch_keyframe_interval_frames", "Number of frames between the two most recent keyframes of an encoder")
+	dropped := s.counter("gst_branch_dropped_frames_total", "Number of frames dropped by videorate")
+	duplicated := s.counter("gst_branch_duplicated_frames_total", "Number of frames duplicated by videorate")
+
+	for i := range m.branches {
+		b := &m.branches[i]
+		frames.add(float64(b.frames), "bin", b.name)
+		bytes.add(float64(b.bytes), "bin", b.name)
+		fps.add(b.fps, "bin", b.name)
+		bitrate.add(b.bitrateKbps, "bin", b.name)
+		if b.encoded {
+			keyframes.add(float64(b.keyframes), "bin", b.name)
+			keyframeInterval.add(float64(b.keyframeInterval), "bin", b.name)
+		}
+		if b.hasVideorate {
+			dropped.add(float64(b.dropped), "bin", b.name)
+			duplicated.add(float64(b.duplicated), "bin", b.name)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func collectAudioMetrics(m *metrics, s *familySet) {
+	rms := s.gauge("audio_level_rms_dbfs", "RMS level of an audio channel in dBFS")
+	peak := s.gauge("audio_level_peak_dbfs", "Peak level of an audio channel in dBFS")
+	silence := s.gauge("audio_silence", "Whether an audio source is silent. 1 if silent, 0 otherwise")
+	clipping := s.gauge("audio_clipping", "Whether an audio source is clipping. 1 if clipping, 0 otherwise")
+	silenceEvents := s.counter("audio_silence_events_total", "Number of times an audio source became silent")
+	clippingEvents := s.counter("audio_clipping_events_total", "Number of times an audio source started clipping")
+	momentary := s.gauge("audio_loudness_momentary_lufs", "Momentary loudness (400ms) of an audio source in LUFS")
+	shortTerm := s.gauge("audio_loudness_shortterm_lufs", "Short-term loudness (3s) of an audio source in LUFS")
+	integrated := s.gauge("audio_loudness_integrated_lufs", "Integrated loudness of an audio source since start in LUFS")
+	loudnessRange := s.gauge("audio_loudness_range_lu", "Loudness range of an audio source in LU")
+	noiseSuppression := s.gauge("audio_dsp_noise_suppression_level", "Noise suppression level of an audio source from 1 (low) to 4 (very high), 0 if disabled")
+	gainControl := s.gauge("audio_dsp_gain_control_enabled", "Whether automatic gain control is enabled for an audio source")
+	echoCancel := s.gauge("audio_dsp_echo_cancel_enabled", "Whether echo cancellation is enabled for an audio source")
+	voice := s.gauge("audio_dsp_voice_detected", "Whether voice is detected in an audio source. 1 if voice, 0 otherwise")
+
+	for source, a := range m.audio {
+		for i, v := range a.rmsDB {
+			rms.add(v, "source", source, "channel", strconv.Itoa(i))
+		}
+		for i, v := range a.peakDB {
+			peak.add(v, "source", source, "channel", strconv.Itoa(i))
+		}
+		silence.add(boolToFloat(a.silence.active), "source", source)
+		clipping.add(boolToFloat(a.clipping.active), "source", source)
+		silenceEvents.add(float64(a.silence.events), "source", source)
+		clippingEvents.add(float64(a.clipping.events), "source", source)
+
+		if l := a.loudness; l != nil {
+			momentary.add(l.momentaryLUFS, "source", source)
+			shortTerm.add(l.shortTermLUFS, "source", source)
+			integrated.add(l.integratedLUFS, "source", source)
+			loudnessRange.add(l.rangeLU, "source", source)
+		}
+
+		if dsp := a.dsp; dsp != nil {
+			noiseSuppression.add(float64(dsp.noiseSuppressionLevel()), "source", source)
+			gainControl.add(boolToFloat(dsp.gainControl), "source", source)
+			echoCancel.add(boolToFloat(dsp.echoCancel), "source", source)
+			voice.add(boolToFloat(dsp.voice), "source", source)
 		}
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// duration of the HLS segments of the multiview in seconds
+	hlsTargetDuration = 2
+	// name of the HLS playlist in -multiview-hls-dir
+	hlsPlaylist = "playlist.m3u8"
+
+	// range and number of cells of the audio meters of the multiview
+	meterMinDB = -60.0
+	meterCells = 20
+)
+
+// Returns a meter of the RMS level of the loudest channel, followed by its
+// peak level in dBFS
+func levelMeter(rmsDB, peakDB []float64) string {
+	rms := slices.Max(rmsDB)
+	peak := slices.Max(peakDB)
+	filled := int(math.Round((min(max(rms, meterMinDB), 0) - meterMinDB) / -meterMinDB * meterCells))
+	return strings.Repeat("█", filled) + strings.Repeat("░", meterCells-filled) + fmt.Sprintf(" %5.1f", max(peak, meterMinDB))
+}
+
+// Render the levels of all audio inputs on the audio tile of the multiview.
+// Called for every level message.
+func (d *daemon) updateMultiviewMeters() {
+	p := d.pipeline
+	if p.multiviewMeters == nil {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Audio")
+	d.mu.RLock()
+	for _, in := range p.audioInputs {
+		a := d.metrics.audio[in.config.name]
+		if len(a.rmsDB) == 0 || len(a.peakDB) == 0 {
+			continue
+		}
+		state := ""
+		switch {
+		case a.clipping.active:
+			state = " CLIP"
+		case a.silence.active:
+			state = " SILENT"
+		}
+		fmt.Fprintf(&b, "\n%-10.10s %s%s", in.config.name, levelMeter(a.rmsDB, a.peakDB), state)
+	}
+	d.mu.RUnlock()
+
+	p.multiviewMeters.SetProperty("text", b.String())
+}
+
+// Serve the HLS playlist and segments of the multiview
+func (h *httpServer) setupHLSHandlers() {
+	dir := h.config().multiviewHLSDir
+	if dir == "" {
+		return
+	}
+	files := http.StripPrefix("/hls/multiview/", http.FileServer(http.Dir(dir)))
+	http.HandleFunc("/hls/multiview/", h.withScope(scopeRead, files.ServeHTTP))
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A minimal Prometheus registry. Collectors add samples to metric families
+// which are encoded in the Prometheus text format or in OpenMetrics.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+const (
+	contentTypePrometheusText = "text/plain; version=0.0.4; charset=utf-8"
+	contentTypeOpenMetrics    = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+type metricType string
+
+const (
+	metricCounter   metricType = "counter"
+	metricGauge     metricType = "gauge"
+	metricHistogram metricType = "histogram"
+)
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	suffix string // e.g. '_bucket' for histograms
+	labels []label
+	value  float64
+}
+
+// A metricFamily groups all samples of a metric. Counter names end in '_total'.
+type metricFamily struct {
+	name    string
+	help    string
+	typ     metricType
+	samples []sample
+}
+
+// Convert alternating label names and values to labels
+func labelPairs(kv []string) []label {
+	if len(kv)%2 != 0 {
+		panic("labels must be name/value pairs")
+	}
+	labels := make([]label, 0, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		labels = append(labels, label{name: kv[i], value: kv[i+1]})
+	}
+	return labels
+}
+
+// Add a sample with labels given as alternating names and values
+func (f *metricFamily) add(value float64, labels ...string) {
+	f.samples = append(f.samples, sample{labels: labelPairs(labels), value: value})
+}
+
+// A histogram counts observations in buckets with the given upper bounds
+type histogram struct {
+	bounds []float64 // ascending, excluding +Inf
+	counts []uint64  // per bucket, not cumulative. The last bucket is +Inf.
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) clone() *histogram {
+	c := *h
+	c.counts = slices.Clone(h.counts)
+	return &c
+}
+
+// Add the '_bucket', '_sum' and '_count' samples of h
+func (f *metricFamily) addHistogram(h *histogram, labels ...string) {
+	base := labelPairs(labels)
+	bucket := func(le float64, value uint64) {
+		l := append(slices.Clone(base), label{name: "le", value: formatFloat(le)})
+		f.samples = append(f.samples, sample{suffix: "_bucket", labels: l, value: float64(value)})
+	}
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		bucket(bound, cumulative)
+	}
+	bucket(math.Inf(1), h.count)
+
+	f.samples = append(f.samples,
+		sample{suffix: "_sum", labels: base, value: h.sum},
+		sample{suffix: "_count", labels: base, value: float64(h.count)},
+	)
+}
+
+// familySet collects the families of a single scrape. Collectors retrieve
+// families by name, so that samples of the same metric from different
+// sources end up in one family.
+type familySet struct {
+	families map[string]*metricFamily
+}
+
+func (s *familySet) family(name string, help string, typ metricType) *metricFamily {
+	if f, ok := s.families[name]; ok {
+		if f.typ != typ {
+			panic(fmt.Sprintf("metric '%s' registered as %s and %s", name, f.typ, typ))
+		}
+		return f
+	}
+	f := &metricFamily{name: name, help: help, typ: typ}
+	s.families[name] = f
+	return f
+}
+
+func (s *familySet) counter(name string, help string) *metricFamily {
+	return s.family(name, help, metricCounter)
+}
+
+func (s *familySet) gauge(name string, help string) *metricFamily {
+	return s.family(name, help, metricGauge)
+}
+
+func (s *familySet) histogram(name string, help string) *metricFamily {
+	return s.family(name, help, metricHistogram)
+}
+
+// A collector adds the samples derived from a metrics snapshot to s
+type collector func(m *metrics, s *familySet)
+
+type registry struct {
+	collectors []collector
+}
+
+func (r *registry) register(c collector) {
+	r.collectors = append(r.collectors, c)
+}
+
+// Run all collectors on m and return the families sorted by name
+func (r *registry) gather(m *metrics) []*metricFamily {
+	s := &familySet{families: make(map[string]*metricFamily)}
+	for _, c := range r.collectors {
+		c(m, s)
+	}
+
+	families := make([]*metricFamily, 0, len(s.families))
+	for _, f := range s.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	return families
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, s *sample) {
+	w.WriteString(name)
+	w.WriteString(s.suffix)
+	if len(s.labels) > 0 {
+		w.WriteByte('{')
+		for i, l := range s.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l.name, labelValueReplacer.Replace(l.value))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(s.value))
+	w.WriteByte('\n')
+}
+
+// Encode families in the Prometheus text format
+func writePrometheusText(out io.Writer, families []*metricFamily) error {
+	w := bufio.NewWriter(out)
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpReplacer.Replace(f.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		for i := range f.samples {
+			writeSample(w, f.name, &f.samples[i])
+		}
+	}
+	return w.Flush()
+}
+
+// Encode families in the OpenMetrics text format. The family name of a
+// counter does not include the '_total' suffix.
+func writeOpenMetrics(out io.Writer, families []*metricFamily) error {
+	w := bufio.NewWriter(out)
+	for _, f := range families {
+		name := f.name
+		if f.typ == metricCounter {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.typ)
+		fmt.Fprintf(w, "# HELP %s %s\n", name, helpReplacer.Replace(f.help))
+		for i := range f.samples {
+			writeSample(w, f.name, &f.samples[i])
+		}
+	}
+	w.WriteString("# EOF\n")
+	return w.Flush()
+}
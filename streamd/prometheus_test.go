@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// Families covering all metric types, label escaping, and special values
+func testFamilies() []*metricFamily {
+	var r registry
+	r.register(func(m *metrics, s *familySet) {
+		s.gauge("streamd_up", "Whether the pipeline is up").add(1)
+		s.counter("streamd_frames_total", "Frames\\processed\nper source").add(42, "source", `cam "1"`, "path", `C:\dev`+"\n")
+		h := newHistogram([]float64{0.1, 1})
+		for _, v := range []float64{0.05, 0.5, 0.5, 2} {
+			h.observe(v)
+		}
+		s.histogram("streamd_latency_seconds", "Latency").addHistogram(h, "output", "combined")
+	})
+	r.register(func(m *metrics, s *familySet) {
+		// Samples of the same name from another collector join the family
+		s.counter("streamd_frames_total", "").add(7, "source", "present", "path", "")
+		s.gauge("streamd_offset", "Offset").add(math.Inf(-1))
+		s.family("streamd_offset", "", metricGauge).add(math.NaN())
+	})
+	return r.gather(&metrics{})
+}
+
+func TestWritePrometheusText(t *testing.T) {
+	want := `# HELP streamd_frames_total Frames\\processed\nper source
+# TYPE streamd_frames_total counter
+streamd_frames_total{source="cam \"1\"",path="C:\\dev\n"} 42
+streamd_frames_total{source="present",path=""} 7
+# HELP streamd_latency_seconds Latency
+# TYPE streamd_latency_seconds histogram
+streamd_latency_seconds_bucket{output="combined",le="0.1"} 1
+streamd_latency_seconds_bucket{output="combined",le="1"} 3
+streamd_latency_seconds_bucket{output="combined",le="+Inf"} 4
+streamd_latency_seconds_sum{output="combined"} 3.05
+streamd_latency_seconds_count{output="combined"} 4
+# HELP streamd_offset Offset
+# TYPE streamd_offset gauge
+streamd_offset -Inf
+streamd_offset NaN
+# HELP streamd_up Whether the pipeline is up
+# TYPE streamd_up gauge
+streamd_up 1
+`
+	var b strings.Builder
+	if err := writePrometheusText(&b, testFamilies()); err != nil {
+		t.Fatalf("writePrometheusText() failed: %v", err)
+	}
+	if b.String() != want {
+		t.Errorf("writePrometheusText() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	want := `# TYPE streamd_frames counter
+# HELP streamd_frames Frames\\processed\nper source
+streamd_frames_total{source="cam \"1\"",path="C:\\dev\n"} 42
+streamd_frames_total{source="present",path=""} 7
+# TYPE streamd_latency_seconds histogram
+# HELP streamd_latency_seconds Latency
+streamd_latency_seconds_bucket{output="combined",le="0.1"} 1
+streamd_latency_seconds_bucket{output="combined",le="1"} 3
+streamd_latency_seconds_bucket{output="combined",le="+Inf"} 4
+streamd_latency_seconds_sum{output="combined"} 3.05
+streamd_latency_seconds_count{output="combined"} 4
+# TYPE streamd_offset gauge
+# HELP streamd_offset Offset
+streamd_offset -Inf
+streamd_offset NaN
+# TYPE streamd_up gauge
+# HELP streamd_up Whether the pipeline is up
+streamd_up 1
+# EOF
+`
+	var b strings.Builder
+	if err := writeOpenMetrics(&b, testFamilies()); err != nil {
+		t.Fatalf("writeOpenMetrics() failed: %v", err)
+	}
+	if b.String() != want {
+		t.Errorf("writeOpenMetrics() =\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{value: 0, want: "0"},
+		{value: 42, want: "42"},
+		{value: -0.25, want: "-0.25"},
+		{value: 1e21, want: "1e+21"},
+		{value: 1.5e-7, want: "1.5e-07"},
+		{value: math.Inf(1), want: "+Inf"},
+		{value: math.Inf(-1), want: "-Inf"},
+		{value: math.NaN(), want: "NaN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatFloat(tt.value); got != tt.want {
+				t.Errorf("formatFloat(%v) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFamilyTypeMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a counter as gauge did not panic")
+		}
+	}()
+	s := &familySet{families: make(map[string]*metricFamily)}
+	s.counter("streamd_frames_total", "")
+	s.gauge("streamd_frames_total", "")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-gst/go-gst/gst"
+	"k8s.io/klog"
+)
+
+var errNoRawVideo = errors.New("device supports no raw video formats")
+
+// sourceProbe is the result of probing the formats supported by the device of
+// a video source
+type sourceProbe struct {
+	// caps structures supported by the device
+	available []string
+	// format requested from the device. The frame rate is zero if the device
+	// does not support the configured frame rate.
+	chosen videoCapsFilter
+	// whether the chosen format differs from the configured format and is
+	// scaled, letterboxed, or frame rate converted in the source bin
+	converted bool
+}
+
+// Returns the caps requested from the device
+func (p *sourceProbe) deviceCaps() string {
+	caps := fmt.Sprintf("video/x-raw,width=%d,height=%d", p.chosen.Width, p.chosen.Height)
+	if p.chosen.Framerate.Nominator != 0 {
+		caps += fmt.Sprintf(",framerate=%d/%d", p.chosen.Framerate.Nominator, p.chosen.Framerate.Denominator)
+	}
+	return caps
+}
+
+// Open the V4L2 device given by opts and choose the format that matches want
+// best
+func probeV4L2Source(name string, opts string, want videoCapsFilter) (*sourceProbe, error) {
+	srcName := "v4l2src_probe_" + name
+	bin, err := gst.NewBinFromString(fmt.Sprintf("v4l2src name=%s %s", srcName, opts), false)
+	if err != nil {
+		return nil, err
+	}
+	src, err := bin.GetElementByName(srcName)
+	if err != nil {
+		return nil, err
+	}
+	// The device is opened in READY, which is sufficient to query its formats
+	if err := bin.BlockSetState(gst.StateReady); err != nil {
+		return nil, fmt.Errorf("failed to open device: %w", err)
+	}
+	defer bin.BlockSetState(gst.StateNull)
+
+	pad := src.GetStaticPad("src")
+	if pad == nil {
+		return nil, fmt.Errorf("failed to get static pad 'src' from '%s' element", srcName)
+	}
+	caps := pad.QueryCaps(nil)
+	if caps == nil {
+		return nil, fmt.Errorf("failed to query caps of '%s'", srcName)
+	}
+	return chooseVideoFormat(caps, want)
+}
+
+// A format offered by a device
+type videoFormatCandidate struct {
+	width, height int
+	// whether the configured frame rate is supported
+	framerate bool
+}
+
+// Returns whether the candidate covers the configured resolution, i.e. is
+// only scaled down
+func (c *videoFormatCandidate) covers(want videoCapsFilter) bool {
+	return c.width >= want.Width && c.height >= want.Height
+}
+
+// Returns whether candidate a matches want better than b. Resolutions that
+// cover want are preferred, the smallest of them, and otherwise the largest
+// resolution. A supported frame rate breaks ties.
+func (a *videoFormatCandidate) betterThan(b *videoFormatCandidate, want videoCapsFilter) bool {
+	if a.covers(want) != b.covers(want) {
+		return a.covers(want)
+	}
+	areaA, areaB := a.width*a.height, b.width*b.height
+	if areaA != areaB {
+		if a.covers(want) {
+			return areaA < areaB
+		}
+		return areaA > areaB
+	}
+	return a.framerate && !b.framerate
+}
+
+// Choose the format of caps that matches want best. Only raw video is
+// considered, as the source bins do not decode.
+func chooseVideoFormat(caps *gst.Caps, want videoCapsFilter) (*sourceProbe, error) {
+	wantCaps := want
+	wantCaps.Mimetype = "video/x-raw"
+	exact := gst.NewCapsFromString(strings.Trim(wantCaps.string(), "\""))
+	size := gst.NewCapsFromString(fmt.Sprintf("video/x-raw,width=%d,height=%d", want.Width, want.Height))
+	rate := gst.NewCapsFromString(fmt.Sprintf("video/x-raw,framerate=%d/%d", want.Framerate.Nominator, want.Framerate.Denominator))
+
+	p := &sourceProbe{}
+	var best *videoFormatCandidate
+	for i := 0; i < caps.GetSize(); i++ {
+		s := caps.GetStructureAt(i)
+		p.available = append(p.available, s.String())
+		if s.Name() != "video/x-raw" {
+			continue
+		}
+
+		n := caps.CopyNth(uint(i))
+		c := &videoFormatCandidate{framerate: !n.Intersect(rate).IsEmpty()}
+		if !n.Intersect(exact).IsEmpty() {
+			c.width, c.height = want.Width, want.Height
+		} else if valueTo(s, "width", &c.width) != nil || valueTo(s, "height", &c.height) != nil {
+			// Ranges of sizes are offered by some capture cards. Only
+			// the configured size is considered.
+			if n.Intersect(size).IsEmpty() {
+				continue
+			}
+			c.width, c.height = want.Width, want.Height
+		}
+		if best == nil || c.betterThan(best, want) {
+			best = c
+		}
+	}
+	if best == nil {
+		return p, errNoRawVideo
+	}
+
+	p.chosen = videoCapsFilter{Mimetype: "video/x-raw", Width: best.width, Height: best.height}
+	if best.framerate {
+		p.chosen.Framerate = want.Framerate
+	}
+	p.converted = !best.framerate || best.width != want.Width || best.height != want.Height
+	return p, nil
+}
+
+// Probe the V4L2 device of a source and log the chosen format
+func probeVideoSource(name, opts string, want videoCapsFilter) (*sourceProbe, error) {
+	p, err := probeV4L2Source(name, opts, want)
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe formats of source '%s': %w", name, err)
+	}
+	if p.converted {
+		klog.Warningf("source '%s' does not support %dx%d at %d/%d fps, capturing %s and converting", name, want.Width, want.Height, want.Framerate.Nominator, want.Framerate.Denominator, p.deviceCaps())
+	} else {
+		klog.Infof("source '%s' captures %s", name, p.deviceCaps())
+	}
+	return p, nil
+}
+
+// Creates the V4L2SourceBin of a source capturing the format chosen by probing
+// its device
+func (p *pipeline) newProbedV4L2SourceBin(source, name, opts string, caps videoCapsFilter) (*gst.Bin, error) {
+	probe, err := probeVideoSource(source, opts, caps)
+	if err != nil {
+		return nil, err
+	}
+	p.sourceProbes[source] = probe
+	if probe.converted {
+		// Letterbox instead of changing the pixel aspect ratio
+		caps.Other = "pixel-aspect-ratio=1/1"
+	}
+	return newV4L2SourceBin(name, opts, probe.deviceCaps(), caps)
+}
+
+// Creates the DecklinkVideoSourceBin of a source. Decklink sources are not
+// probed: the card captures the mode of the incoming signal, which is only
+// detected once the pipeline is playing, and the modes the card supports say
+// nothing about the signal. The detected mode is converted to the configured
+// format and listed as captureCaps by the API.
+func (p *pipeline) newUnprobedDecklinkSourceBin(source, name, opts string, settings videoSourceSettings, caps videoCapsFilter) (*gst.Bin, error) {
+	klog.Infof("source '%s' is not probed, the mode detected by decklinkvideosrc is converted to %dx%d at %d/%d fps", source, caps.Width, caps.Height, caps.Framerate.Nominator, caps.Framerate.Denominator)
+	return newDecklinkVideoSourceBin(name, opts, settings, caps)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+func TestMain(m *testing.M) {
+	gst.Init(nil)
+	os.Exit(m.Run())
+}
+
+func TestChooseVideoFormat(t *testing.T) {
+	want1080p30 := videoCapsFilter{Mimetype: "video/x-raw", Width: 1920, Height: 1080, Framerate: rational{30, 1}}
+	tests := []struct {
+		name       string
+		caps       string
+		want       videoCapsFilter
+		deviceCaps string
+		converted  bool
+		available  int
+		err        error
+	}{
+		{
+			name:       "exact",
+			caps:       "video/x-raw,format=YUY2,width=1920,height=1080,framerate=30/1",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=1920,height=1080,framerate=30/1",
+			available:  1,
+		},
+		{
+			name:       "frame rate list",
+			caps:       "video/x-raw,format=YUY2,width=1920,height=1080,framerate={ 60/1, 30/1 }",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=1920,height=1080,framerate=30/1",
+			available:  1,
+		},
+		{
+			name:       "smallest covering resolution",
+			caps:       "video/x-raw,width=1280,height=720,framerate=30/1; video/x-raw,width=3840,height=2160,framerate=30/1; video/x-raw,width=2560,height=1440,framerate=30/1",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=2560,height=1440,framerate=30/1",
+			converted:  true,
+			available:  3,
+		},
+		{
+			name:       "largest resolution if none covers",
+			caps:       "video/x-raw,width=640,height=480,framerate=30/1; video/x-raw,width=1280,height=720,framerate=5/1",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=1280,height=720",
+			converted:  true,
+			available:  2,
+		},
+		{
+			name:       "unsupported frame rate",
+			caps:       "video/x-raw,format=YUY2,width=1280,height=720,framerate={ 30/1, 60/1 }; video/x-raw,format=YUY2,width=1920,height=1080,framerate=5/1; image/jpeg,width=1920,height=1080,framerate=30/1",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=1920,height=1080",
+			converted:  true,
+			available:  3,
+		},
+		{
+			name:       "supported frame rate breaks ties",
+			caps:       "video/x-raw,format=NV12,width=1920,height=1080,framerate=5/1; video/x-raw,format=YUY2,width=1920,height=1080,framerate=[ 1/1, 60/1 ]",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=1920,height=1080,framerate=30/1",
+			available:  2,
+		},
+		{
+			name:       "size range",
+			caps:       "video/x-raw,format=UYVY,width=[ 640, 4096 ],height=[ 480, 2160 ],framerate=[ 1/1, 60/1 ]",
+			want:       want1080p30,
+			deviceCaps: "video/x-raw,width=1920,height=1080,framerate=30/1",
+			available:  1,
+		},
+		{
+			name:      "size range without configured size",
+			caps:      "video/x-raw,format=UYVY,width=[ 640, 1280 ],height=[ 480, 720 ],framerate=30/1",
+			want:      want1080p30,
+			available: 1,
+			err:       errNoRawVideo,
+		},
+		{
+			name:      "no raw video",
+			caps:      "image/jpeg,width=1920,height=1080,framerate=30/1",
+			want:      want1080p30,
+			available: 1,
+			err:       errNoRawVideo,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := chooseVideoFormat(gst.NewCapsFromString(tt.caps), tt.want)
+			if len(p.available) != tt.available {
+				t.Errorf("available = %q, want %d structures", p.available, tt.available)
+			}
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("chooseVideoFormat() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("chooseVideoFormat() failed: %v", err)
+			}
+			if got := p.deviceCaps(); got != tt.deviceCaps {
+				t.Errorf("deviceCaps() = %q, want %q", got, tt.deviceCaps)
+			}
+			if p.converted != tt.converted {
+				t.Errorf("converted = %t, want %t", p.converted, tt.converted)
+			}
+		})
+	}
+}
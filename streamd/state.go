@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Directory of the state file if systemd does not provide one
+const defaultStateDirectory = "/var/lib/streamd"
+
+// Returns the default path of the state file. systemd passes the directories
+// of StateDirectory= in STATE_DIRECTORY, separated by colons.
+func defaultStateFile() string {
+	dir, _, _ := strings.Cut(os.Getenv("STATE_DIRECTORY"), ":")
+	if dir == "" {
+		dir = defaultStateDirectory
+	}
+	return filepath.Join(dir, "state.json")
+}
+
+// persistentState holds the changes made at runtime that survive restarts
+type persistentState struct {
+	// key is the name of the audio input
+	Audio map[string]audioInputState `json:"audio"`
+}
+
+type audioInputState struct {
+	Mute          bool    `json:"mute"`
+	GainDB        float64 `json:"gainDb"`
+	Amplification float64 `json:"amplification"`
+}
+
+// stateStore writes the persistent state to a file on every change. The state
+// is only kept in memory if the path is empty.
+type stateStore struct {
+	mu    sync.Mutex
+	path  string
+	state persistentState
+}
+
+// Load the state from path. A missing file yields an empty state.
+func loadStateStore(path string) (*stateStore, error) {
+	s := &stateStore{path: path}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &s.state); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	if s.state.Audio == nil {
+		s.state.Audio = make(map[string]audioInputState)
+	}
+	return s, nil
+}
+
+// Returns the persisted state of an audio input
+func (s *stateStore) audioInput(name string) (audioInputState, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.state.Audio[name]
+	return a, ok
+}
+
+// Persist the state of an audio input
+func (s *stateStore) setAudioInput(name string, a audioInputState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Audio[name] = a
+	return s.save()
+}
+
+// Write the state to a temporary file first, so that it is never truncated
+// by a crash. Must be called with mu held.
+func (s *stateStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
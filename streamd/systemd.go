@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Implementation of the sd_notify protocol without libsystemd.
+// See https://www.freedesktop.org/software/systemd/man/latest/sd_notify.html
+
+// Send a notification to the service manager. Returns false without an error
+// if the daemon is not run by systemd with Type=notify.
+func sdNotify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// Abstract namespace socket
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the watchdog interval configured with WatchdogSec= or 0 if the
+// watchdog is disabled.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// WATCHDOG_PID is optional. If set, it must match our PID.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+func logNotifyError(err error) {
+	if err != nil {
+		klog.Warningf("sd_notify failed: %v", err)
+	}
+}
+
+// Notify the service manager that the daemon is ready. Called by the bus
+// watch once the pipeline reached PLAYING. The HTTP server is already bound
+// at that point.
+func (d *daemon) notifyReady() {
+	if d.notifiedReady.Swap(true) {
+		return
+	}
+	_, err := sdNotify("READY=1\nSTATUS=" + d.statusSummary())
+	logNotifyError(err)
+}
+
+// One-line summary of the daemon state for 'systemctl status'
+func (d *daemon) statusSummary() string {
+	m := d.metricsSnapshot()
+	callers := make([]string, 0, len(m.srtSinks))
+	for _, sink := range m.srtSinks {
+		callers = append(callers, fmt.Sprintf("%s=%d", sink.output, len(sink.stats.callers)))
+	}
+	return fmt.Sprintf("pipeline %s, callers: %s, warnings=%d",
+		m.pipelineStats.state,
+		strings.Join(callers, " "),
+		m.pipelineStats.warnings,
+	)
+}
+
+// Ping the systemd watchdog as long as the GLib main loop and the metrics
+// goroutine make progress. If either stalls, the pings stop and systemd
+// restarts the daemon.
+func (d *daemon) watchdogProcess(ctx context.Context) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	klog.Infof("systemd watchdog enabled with interval %s", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if since := d.mainloopHeartbeat.since(); since > interval/2+mainloopHeartbeatInterval {
+			klog.Errorf("GLib main loop stalled for %s, withholding watchdog ping", since)
+			continue
+		}
+		// The metrics goroutine sleeps for a second between iterations
+		if since := d.metricsHeartbeat.since(); since > interval/2+metricsInterval {
+			klog.Errorf("metrics goroutine stalled for %s, withholding watchdog ping", since)
+			continue
+		}
+
+		_, err := sdNotify("WATCHDOG=1\nSTATUS=" + d.statusSummary())
+		logNotifyError(err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-gst/go-gst/gst"
+	"k8s.io/klog"
+)
+
+// GStreamer tracers log their records to the GST_TRACER debug category. With
+// -tracers, streamd replaces the default log function of GStreamer to collect
+// the records of the latency, proctime, and queuelevel tracers.
+// See https://gstreamer.freedesktop.org/documentation/coretracers/
+const (
+	tracerList          = "latency(flags=element);proctime;queuelevel"
+	tracerDebugCategory = "GST_TRACER"
+)
+
+// Upper bounds of the processing time and latency histograms in seconds
+var tracerHistogramBounds = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type queueLevel struct {
+	bytes      uint
+	maxBytes   uint
+	buffers    uint
+	maxBuffers uint
+	time       time.Duration
+	maxTime    time.Duration
+}
+
+// tracerStats aggregates tracer records. Records are logged from streaming
+// threads, hence tracerStats has its own lock instead of using the daemon's.
+type tracerStats struct {
+	mu sync.Mutex
+	// key is the name of the element
+	procTime map[string]*histogram
+	latency  map[string]*histogram
+	// key is the name of the queue
+	queueLevels map[string]queueLevel
+}
+
+// Enable the tracers through the environment. Must be called before gst.Init.
+func enableTracers() {
+	appendEnv("GST_TRACERS", tracerList, ";")
+	appendEnv("GST_DEBUG", tracerDebugCategory+":7", ",")
+}
+
+func appendEnv(key string, value string, sep string) {
+	if v := os.Getenv(key); v != "" {
+		value = v + sep + value
+	}
+	os.Setenv(key, value)
+}
+
+func newTracerStats() *tracerStats {
+	return &tracerStats{
+		procTime:    make(map[string]*histogram),
+		latency:     make(map[string]*histogram),
+		queueLevels: make(map[string]queueLevel),
+	}
+}
+
+// Replace the default log function of GStreamer. Tracer records are consumed,
+// all other messages are forwarded to klog.
+func (t *tracerStats) installLogFunction() {
+	gst.SetLogFunction(func(category *gst.DebugCategory, level gst.DebugLevel, file string, function string, line int, object *gst.LoggedObject, message *gst.DebugMessage) {
+		name := category.GetName()
+		if name == tracerDebugCategory && level == gst.LevelTrace {
+			t.record(message.Get())
+			return
+		}
+
+		msg := fmt.Sprintf("%s %s:%d:%s:<%s> %s", name, file, line, function, message.GetId(), message.Get())
+		switch level {
+		case gst.LevelError:
+			klog.Error(msg)
+		case gst.LevelWarning:
+			klog.Warning(msg)
+		default:
+			klog.Info(msg)
+		}
+	})
+}
+
+// Parse a tracer record, e.g.
+// 'proctime, element-id=(string)0x55f8, element=(string)x264enc0, time=(string)0:00:00.001234567;'
+func (t *tracerStats) record(msg string) {
+	s := gst.NewStructureFromString(msg)
+	if s == nil {
+		return
+	}
+	defer s.Free()
+
+	switch s.Name() {
+	case "proctime":
+		element, d, ok := tracerElementTime(s)
+		if ok {
+			t.observe(t.procTime, element, d)
+		}
+	case "element-latency":
+		element, d, ok := tracerElementTime(s)
+		if ok {
+			t.observe(t.latency, element, d)
+		}
+	case "queue-level":
+		var queue string
+		var l queueLevel
+		var sizeTime, maxSizeTime uint64
+		if valueTo(s, "queue", &queue) != nil ||
+			valueTo(s, "size_bytes", &l.bytes) != nil ||
+			valueTo(s, "max_size_bytes", &l.maxBytes) != nil ||
+			valueTo(s, "size_buffers", &l.buffers) != nil ||
+			valueTo(s, "max_size_buffers", &l.maxBuffers) != nil ||
+			valueTo(s, "size_time", &sizeTime) != nil ||
+			valueTo(s, "max_size_time", &maxSizeTime) != nil {
+			return
+		}
+		l.time = time.Duration(sizeTime)
+		l.maxTime = time.Duration(maxSizeTime)
+
+		t.mu.Lock()
+		t.queueLevels[queue] = l
+		t.mu.Unlock()
+	}
+}
+
+func (t *tracerStats) observe(histograms map[string]*histogram, element string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := histograms[element]
+	if !ok {
+		h = newHistogram(tracerHistogramBounds)
+		histograms[element] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// Deep copy of the aggregated records for the metrics snapshot
+func (t *tracerStats) snapshot() (procTime map[string]*histogram, latency map[string]*histogram, queueLevels map[string]queueLevel) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	procTime = make(map[string]*histogram, len(t.procTime))
+	for k, h := range t.procTime {
+		procTime[k] = h.clone()
+	}
+	latency = make(map[string]*histogram, len(t.latency))
+	for k, h := range t.latency {
+		latency[k] = h.clone()
+	}
+	queueLevels = make(map[string]queueLevel, len(t.queueLevels))
+	for k, l := range t.queueLevels {
+		queueLevels[k] = l
+	}
+	return procTime, latency, queueLevels
+}
+
+// Depending on the GStreamer version, times are logged either in nanoseconds
+// or as a string in GST_TIME_FORMAT.
+func tracerElementTime(s *gst.Structure) (string, time.Duration, bool) {
+	var element string
+	if valueTo(s, "element", &element) != nil {
+		return "", 0, false
+	}
+	v, err := s.GetValue("time")
+	if err != nil {
+		return "", 0, false
+	}
+	switch v := v.(type) {
+	case uint64:
+		return element, time.Duration(v), true
+	case string:
+		d, err := parseGstTime(v)
+		return element, d, err == nil
+	}
+	return "", 0, false
+}
+
+// Parse a time in GST_TIME_FORMAT, e.g. '0:00:00.001234567'
+func parseGstTime(s string) (time.Duration, error) {
+	var h, m, sec, ns uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d:%d.%d", &h, &m, &sec, &ns); err != nil {
+		return 0, fmt.Errorf("invalid time '%s': %w", s, err)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second + time.Duration(ns), nil
+}
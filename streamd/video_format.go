@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Format of sources and outputs if none is configured
+var defaultVideoFormat = videoCapsFilter{Mimetype: "video/x-raw", Width: 1920, Height: 1080, Framerate: rational{30, 1}}
+
+// '<width>x<height>p<fps>[/<denominator>]', e.g. '1280x720p50' or
+// '1920x1080p30000/1001'
+var videoFormatRegexp = regexp.MustCompile(`^(\d+)x(\d+)p(\d+)(?:/(\d+))?$`)
+
+// Parse a video format such as '3840x2160p25'. Width and height must be even,
+// as required by the 4:2:0 chroma subsampling of the encoders.
+func parseVideoFormat(s string) (videoCapsFilter, error) {
+	m := videoFormatRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return videoCapsFilter{}, fmt.Errorf("invalid video format '%s': expected '<width>x<height>p<fps>[/<denominator>]', e.g. '1280x720p50'", s)
+	}
+	c := videoCapsFilter{Mimetype: "video/x-raw", Framerate: rational{Denominator: 1}}
+	// The regexp only matches digits, only overflows fail
+	var err error
+	for i, v := range []*int{&c.Width, &c.Height, &c.Framerate.Nominator, &c.Framerate.Denominator} {
+		if m[i+1] == "" {
+			continue
+		}
+		if *v, err = strconv.Atoi(m[i+1]); err != nil {
+			return videoCapsFilter{}, fmt.Errorf("invalid video format '%s': %w", s, err)
+		}
+	}
+	if c.Width == 0 || c.Height == 0 || c.Width%2 != 0 || c.Height%2 != 0 {
+		return videoCapsFilter{}, fmt.Errorf("invalid video format '%s': width and height must be even and positive", s)
+	}
+	if c.Framerate.Nominator == 0 || c.Framerate.Denominator == 0 {
+		return videoCapsFilter{}, fmt.Errorf("invalid video format '%s': frame rate must be positive", s)
+	}
+	return c, nil
+}
+
+// Parse '<name>:<format>' into formats. names lists the valid names.
+func parseNamedVideoFormat(formats map[string]videoCapsFilter, names []string, spec string) error {
+	name, format, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("invalid video format '%s': expected '<name>:<format>'", spec)
+	}
+	if !slices.Contains(names, name) {
+		return fmt.Errorf("invalid video format '%s': unknown name '%s', expected one of %s", spec, name, strings.Join(names, ", "))
+	}
+	c, err := parseVideoFormat(format)
+	if err != nil {
+		return err
+	}
+	formats[name] = c
+	return nil
+}
+
+// Returns the configured format of a source
+func (c *daemonConfig) sourceFormat(source string) videoCapsFilter {
+	if f, ok := c.sourceFormats[source]; ok {
+		return f
+	}
+	return defaultVideoFormat
+}
+
+// Returns the format of an output. The presentation and camera outputs
+// default to the format of their source, the combined output to
+// defaultVideoFormat.
+func (c *daemonConfig) outputFormat(output string) videoCapsFilter {
+	if f, ok := c.outputFormats[output]; ok {
+		return f
+	}
+	switch output {
+	case outputPresent:
+		return c.sourceFormat(sourcePresent)
+	case outputCamera:
+		return c.sourceFormat(sourceCamera)
+	}
+	return defaultVideoFormat
+}
+
+// Returns caps with width and height scaled by num/den, rounded down to even
+// numbers
+func scaleVideoCaps(caps videoCapsFilter, num, den int) videoCapsFilter {
+	caps.Width = caps.Width * num / den &^ 1
+	caps.Height = caps.Height * num / den &^ 1
+	return caps
+}
+
+// Returns whether two caps describe the same resolution and frame rate
+func sameVideoFormat(a, b videoCapsFilter) bool {
+	return a.Width == b.Width && a.Height == b.Height &&
+		a.Framerate.Nominator*b.Framerate.Denominator == b.Framerate.Nominator*a.Framerate.Denominator
+}
+
+// Returns the caps an output of a source is converted to, nil if the output
+// has the format of the source
+func (c *daemonConfig) outputConversion(output, source string) *videoCapsFilter {
+	f := c.outputFormat(output)
+	if sameVideoFormat(f, c.sourceFormat(source)) {
+		return nil
+	}
+	return &f
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestParseVideoFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   videoCapsFilter
+		err    bool
+	}{
+		{format: "1280x720p50", want: videoCapsFilter{Mimetype: "video/x-raw", Width: 1280, Height: 720, Framerate: rational{50, 1}}},
+		{format: "1920x1080p30000/1001", want: videoCapsFilter{Mimetype: "video/x-raw", Width: 1920, Height: 1080, Framerate: rational{30000, 1001}}},
+		{format: "3840x2160p25/1", want: videoCapsFilter{Mimetype: "video/x-raw", Width: 3840, Height: 2160, Framerate: rational{25, 1}}},
+		{format: "1281x720p50", err: true},
+		{format: "1280x721p50", err: true},
+		{format: "0x720p50", err: true},
+		{format: "1280x720p0", err: true},
+		{format: "1280x720p30/0", err: true},
+		{format: "1280x720", err: true},
+		{format: "1280x720p", err: true},
+		{format: "1280x720i50", err: true},
+		{format: "-1280x720p50", err: true},
+		{format: " 1280x720p50", err: true},
+		{format: "99999999999999999999x720p50", err: true},
+		{format: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got, err := parseVideoFormat(tt.format)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseVideoFormat() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVideoFormat() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseVideoFormat() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScaleVideoCaps(t *testing.T) {
+	tests := []struct {
+		name                  string
+		width, height         int
+		num, den              int
+		wantWidth, wantHeight int
+	}{
+		{name: "identity", width: 1920, height: 1080, num: 1, den: 1, wantWidth: 1920, wantHeight: 1080},
+		{name: "half", width: 1920, height: 1080, num: 1, den: 2, wantWidth: 960, wantHeight: 540},
+		{name: "third", width: 1920, height: 1080, num: 1, den: 3, wantWidth: 640, wantHeight: 360},
+		{name: "quarter", width: 1280, height: 720, num: 1, den: 4, wantWidth: 320, wantHeight: 180},
+		{name: "odd results rounded down", width: 1920, height: 1080, num: 1, den: 8, wantWidth: 240, wantHeight: 134},
+		{name: "fractions rounded down", width: 1366, height: 768, num: 2, den: 3, wantWidth: 910, wantHeight: 512},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps := videoCapsFilter{Mimetype: "video/x-raw", Width: tt.width, Height: tt.height, Framerate: rational{25, 1}, Other: "pixel-aspect-ratio=1/1"}
+			want := caps
+			want.Width, want.Height = tt.wantWidth, tt.wantHeight
+			if got := scaleVideoCaps(caps, tt.num, tt.den); got != want {
+				t.Errorf("scaleVideoCaps(%dx%d, %d, %d) = %+v, want %+v", tt.width, tt.height, tt.num, tt.den, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-gst/go-gst/gst"
+)
+
+// Values of the settings of Decklink video sources. 'auto' uses what
+// decklinkvideosrc reports for the detected mode.
+var (
+	deinterlaceModes = []string{"auto", "on", "off"}
+	// methods of the deinterlace element
+	deinterlaceMethods = []string{"linear", "linearblend", "greedyh", "greedyl", "vfir", "tomsmocomp", "scalerbob", "yadif"}
+	fieldOrders        = []string{"auto", "tff", "bff"}
+	colorimetries      = []string{"auto", "bt601", "bt709", "bt2020"}
+	colorRanges        = []string{"auto", "full", "limited"}
+)
+
+// Colorimetry as '<matrix>:<transfer>:<primaries>' of GstVideoColorimetry, the
+// range is prepended
+var colorimetryComponents = map[string]string{
+	"bt601":  "4:16:4",
+	"bt709":  "3:5:1",
+	"bt2020": "6:11:7",
+}
+
+// videoSourceSettings configures the deinterlacing and colour space handling
+// of a Decklink video source
+type videoSourceSettings struct {
+	deinterlace       string
+	deinterlaceMethod string // empty for the default of the deinterlace element
+	fieldOrder        string
+	colorimetry       string
+	colorRange        string
+}
+
+var defaultVideoSourceSettings = videoSourceSettings{
+	deinterlace: "auto",
+	fieldOrder:  "auto",
+	colorimetry: "auto",
+	colorRange:  "auto",
+}
+
+// Parse '<source>:<setting>[,<setting>...]' into settings, e.g.
+// 'camera:deinterlace=on,field-order=tff,colorimetry=bt709,range=limited'
+func parseVideoSourceSettings(settings map[string]videoSourceSettings, spec string) error {
+	source, list, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("invalid video source settings '%s': expected '<source>:<setting>[,<setting>...]'", spec)
+	}
+	if source != sourceCamera && source != sourcePresent {
+		return fmt.Errorf("invalid video source settings '%s': unknown source '%s'", spec, source)
+	}
+	s, ok := settings[source]
+	if !ok {
+		s = defaultVideoSourceSettings
+	}
+
+	for _, setting := range strings.Split(list, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+
+		var dest *string
+		var values []string
+		switch key {
+		case "deinterlace":
+			dest, values = &s.deinterlace, deinterlaceModes
+		case "deinterlace-method":
+			dest, values = &s.deinterlaceMethod, deinterlaceMethods
+		case "field-order":
+			dest, values = &s.fieldOrder, fieldOrders
+		case "colorimetry":
+			dest, values = &s.colorimetry, colorimetries
+		case "range":
+			dest, values = &s.colorRange, colorRanges
+		default:
+			return fmt.Errorf("invalid video source setting '%s': unknown setting '%s'", setting, key)
+		}
+		if !slices.Contains(values, value) {
+			return fmt.Errorf("invalid video source setting '%s': expected one of %s", setting, strings.Join(values, ", "))
+		}
+		*dest = value
+	}
+
+	if s.colorRange != "auto" && s.colorimetry == "auto" {
+		return fmt.Errorf("invalid video source settings '%s': range requires colorimetry", spec)
+	}
+	settings[source] = s
+	return nil
+}
+
+// Validate that settings are only given for Decklink sources
+func (c *daemonConfig) resolveVideoSourceSettings() error {
+	factories := map[string]string{sourceCamera: c.sourceCam, sourcePresent: c.sourcePresent}
+	for source := range c.videoSourceSettings {
+		if factories[source] != "decklinkvideosrc" {
+			return fmt.Errorf("video source settings of source '%s' require decklinkvideosrc", source)
+		}
+	}
+	return nil
+}
+
+// Returns the settings of a source
+func (c *daemonConfig) videoSettings(source string) videoSourceSettings {
+	if s, ok := c.videoSourceSettings[source]; ok {
+		return s
+	}
+	return defaultVideoSourceSettings
+}
+
+// Returns the colorimetry overriding the one reported by the source, empty if
+// not overridden
+func (s *videoSourceSettings) colorimetryOverride() string {
+	switch {
+	case s.colorimetry == "auto":
+		return ""
+	case s.colorRange == "auto":
+		return s.colorimetry
+	case s.colorRange == "full":
+		return "1:" + colorimetryComponents[s.colorimetry]
+	default:
+		return "2:" + colorimetryComponents[s.colorimetry]
+	}
+}
+
+// Returns the description of the elements correcting the caps of and
+// deinterlacing a video source. Empty if the source is passed unchanged.
+func videoSourceProcessingDesc(name string, s videoSourceSettings) string {
+	// Fields given by the caps of the source are overridden by capssetter
+	var fields []string
+	if c := s.colorimetryOverride(); c != "" {
+		fields = append(fields, "colorimetry="+c)
+	}
+	switch s.fieldOrder {
+	case "tff":
+		fields = append(fields, "field-order=top-field-first")
+	case "bff":
+		fields = append(fields, "field-order=bottom-field-first")
+	}
+
+	var descs []string
+	if len(fields) > 0 {
+		descs = append(descs, fmt.Sprintf("capssetter name=capssetter_%s join=true replace=false caps=\"video/x-raw,%s\"", name, strings.Join(fields, ",")))
+	}
+	if s.deinterlace != "off" {
+		// In auto mode, only frames flagged as interlaced are deinterlaced.
+		// Both fields are output as frames, doubling the frame rate of
+		// interlaced sources before videorate.
+		mode := "auto"
+		if s.deinterlace == "on" {
+			mode = "interlaced"
+		}
+		desc := fmt.Sprintf("deinterlace name=deinterlace_%s mode=%s fields=all tff=%s", name, mode, s.fieldOrder)
+		if s.deinterlaceMethod != "" {
+			desc += " method=" + s.deinterlaceMethod
+		}
+		descs = append(descs, desc)
+	}
+	if len(descs) == 0 {
+		return ""
+	}
+	return strings.Join(descs, " ! ") + " ! "
+}
+
+// Returns the caps negotiated by the decklinkvideosrc of a source bin, which
+// describe the interlacing and colorimetry of the detected mode. Empty if not
+// negotiated yet.
+func decklinkCaps(bin *gst.Bin) string {
+	src, err := bin.GetElementByName("decklinkvideosrc_" + bin.GetName())
+	if err != nil {
+		return ""
+	}
+	pad := src.GetStaticPad("src")
+	if pad == nil {
+		return ""
+	}
+	if caps := pad.GetCurrentCaps(); caps != nil {
+		return caps.String()
+	}
+	return ""
+}
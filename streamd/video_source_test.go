@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVideoSourceSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		specs []string
+		want  map[string]videoSourceSettings
+		err   bool
+	}{
+		{
+			name:  "defaults",
+			specs: []string{"camera:deinterlace=auto"},
+			want:  map[string]videoSourceSettings{sourceCamera: defaultVideoSourceSettings},
+		},
+		{
+			name:  "all settings",
+			specs: []string{"camera:deinterlace=on, deinterlace-method=yadif,field-order=tff,colorimetry=bt709,range=limited"},
+			want: map[string]videoSourceSettings{
+				sourceCamera: {deinterlace: "on", deinterlaceMethod: "yadif", fieldOrder: "tff", colorimetry: "bt709", colorRange: "limited"},
+			},
+		},
+		{
+			name:  "repeated sources are merged",
+			specs: []string{"present:deinterlace=off", "present:colorimetry=bt601", "camera:field-order=bff"},
+			want: map[string]videoSourceSettings{
+				sourcePresent: {deinterlace: "off", fieldOrder: "auto", colorimetry: "bt601", colorRange: "auto"},
+				sourceCamera:  {deinterlace: "auto", fieldOrder: "bff", colorimetry: "auto", colorRange: "auto"},
+			},
+		},
+		{
+			name:  "range after colorimetry",
+			specs: []string{"camera:colorimetry=bt2020", "camera:range=full"},
+			want: map[string]videoSourceSettings{
+				sourceCamera: {deinterlace: "auto", fieldOrder: "auto", colorimetry: "bt2020", colorRange: "full"},
+			},
+		},
+		{name: "range without colorimetry", specs: []string{"camera:range=full"}, err: true},
+		{name: "missing source", specs: []string{"deinterlace=on"}, err: true},
+		{name: "unknown source", specs: []string{"multiview:deinterlace=on"}, err: true},
+		{name: "unknown setting", specs: []string{"camera:brightness=1"}, err: true},
+		{name: "invalid value", specs: []string{"camera:field-order=top"}, err: true},
+		{name: "missing value", specs: []string{"camera:deinterlace"}, err: true},
+		{name: "empty setting", specs: []string{"camera:deinterlace=on,"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := make(map[string]videoSourceSettings)
+			var err error
+			for _, spec := range tt.specs {
+				if err = parseVideoSourceSettings(settings, spec); err != nil {
+					break
+				}
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseVideoSourceSettings() succeeded with %+v, want error", settings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseVideoSourceSettings() failed: %v", err)
+			}
+			if !reflect.DeepEqual(settings, tt.want) {
+				t.Errorf("settings = %+v, want %+v", settings, tt.want)
+			}
+		})
+	}
+}
+
+func TestColorimetryOverride(t *testing.T) {
+	tests := []struct {
+		colorimetry string
+		colorRange  string
+		want        string
+	}{
+		{colorimetry: "auto", colorRange: "auto", want: ""},
+		{colorimetry: "bt709", colorRange: "auto", want: "bt709"},
+		{colorimetry: "bt601", colorRange: "auto", want: "bt601"},
+		{colorimetry: "bt709", colorRange: "full", want: "1:3:5:1"},
+		{colorimetry: "bt709", colorRange: "limited", want: "2:3:5:1"},
+		{colorimetry: "bt601", colorRange: "limited", want: "2:4:16:4"},
+		{colorimetry: "bt2020", colorRange: "full", want: "1:6:11:7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.colorimetry+"/"+tt.colorRange, func(t *testing.T) {
+			s := defaultVideoSourceSettings
+			s.colorimetry, s.colorRange = tt.colorimetry, tt.colorRange
+			if got := s.colorimetryOverride(); got != tt.want {
+				t.Errorf("colorimetryOverride() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
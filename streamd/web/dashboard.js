@@ -0,0 +1,215 @@
+"use strict";
+
+const statusURL = "../api/v1/status";
+const audioURL = "../api/v1/audio";
+const statusInterval = 1000;
+const snapshotInterval = 2000;
+const snapshotWidth = 640;
+const tokenKey = "streamd-token";
+// Range of the audio meters in dBFS
+const meterMinDB = -60;
+// RMS level above which a meter is highlighted
+const meterHotDB = -10;
+
+// Pending token prompt, shared by all requests failing with 401 at the same
+// time so that the user is only asked once
+let tokenPrompt = null;
+
+function promptToken() {
+	if (tokenPrompt === null) {
+		tokenPrompt = new Promise((resolve) => {
+			// Defer the blocking prompt until all concurrent requests failed
+			setTimeout(() => {
+				const entered = window.prompt("streamd requires a bearer token");
+				if (entered) {
+					localStorage.setItem(tokenKey, entered.trim());
+				}
+				tokenPrompt = null;
+				resolve();
+			});
+		});
+	}
+	return tokenPrompt;
+}
+
+// Fetch a resource with the bearer token stored in the browser. Asks for a
+// token if the server requires authentication.
+async function authFetch(url) {
+	const headers = {};
+	const token = localStorage.getItem(tokenKey);
+	if (token) {
+		headers["Authorization"] = "Bearer " + token;
+	}
+
+	const resp = await fetch(url, { cache: "no-store", headers: headers });
+	if (resp.status === 401) {
+		await promptToken();
+	}
+	if (!resp.ok) {
+		throw new Error(resp.status + " " + resp.statusText);
+	}
+	return resp;
+}
+
+// Load an image via authFetch, as <img> cannot send the Authorization header
+async function loadImage(img, url) {
+	try {
+		const blob = await (await authFetch(url)).blob();
+		const old = img.src;
+		img.src = URL.createObjectURL(blob);
+		if (old.startsWith("blob:")) {
+			URL.revokeObjectURL(old);
+		}
+	} catch (err) {
+		img.alt = String(err);
+	}
+}
+
+function el(tag, text, className) {
+	const e = document.createElement(tag);
+	if (text !== undefined) {
+		e.textContent = text;
+	}
+	if (className !== undefined) {
+		e.className = className;
+	}
+	return e;
+}
+
+function formatBytes(n) {
+	const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return n.toFixed(i === 0 ? 0 : 1) + " " + units[i];
+}
+
+function renderState(state) {
+	const e = document.getElementById("pipeline-state");
+	e.textContent = state;
+	e.className = "state " + state.toLowerCase();
+}
+
+function renderOutputs(outputs) {
+	const list = document.getElementById("output-list");
+	list.replaceChildren();
+
+	for (const output of outputs) {
+		list.appendChild(el("h3", `${output.name} (${output.callers.length} callers, ${formatBytes(output.bytesSentTotal)} sent)`));
+		if (output.callers.length === 0) {
+			continue;
+		}
+
+		const table = el("table");
+		const head = el("tr");
+		for (const h of ["Caller", "Rate (Mbps)", "Bandwidth (Mbps)", "RTT (ms)", "Latency (ms)", "Sent", "Lost", "Dropped", "Retransmitted"]) {
+			head.appendChild(el("th", h));
+		}
+		table.appendChild(head);
+
+		for (const c of output.callers) {
+			const row = el("tr");
+			row.appendChild(el("td", `${c.address}:${c.port}`));
+			row.appendChild(el("td", c.sendRateMbps.toFixed(2), "num"));
+			row.appendChild(el("td", c.bandwidthMbps.toFixed(2), "num"));
+			row.appendChild(el("td", c.rttMs.toFixed(1), "num"));
+			row.appendChild(el("td", c.negotiatedLatencyMs, "num"));
+			row.appendChild(el("td", formatBytes(c.bytesSent), "num"));
+			row.appendChild(el("td", c.packetsSentLost, "num"));
+			row.appendChild(el("td", c.packetsSentDropped, "num"));
+			row.appendChild(el("td", c.packetsRetransmitted, "num"));
+			table.appendChild(row);
+		}
+		list.appendChild(table);
+	}
+}
+
+function renderPipeline(status) {
+	document.getElementById("warnings").textContent = status.pipeline.warnings;
+	document.getElementById("load-avg").textContent = status.system.loadAvg.map((l) => l.toFixed(2)).join(" / ");
+
+	const body = document.getElementById("qos-events");
+	body.replaceChildren();
+	for (const [element, events] of Object.entries(status.pipeline.qosEvents || {})) {
+		const row = el("tr");
+		row.appendChild(el("td", element));
+		row.appendChild(el("td", events, "num"));
+		body.appendChild(row);
+	}
+}
+
+// Returns the width of a meter in percent
+function meterWidth(db) {
+	return Math.min(Math.max((db - meterMinDB) / -meterMinDB, 0), 1) * 100;
+}
+
+function renderAudio(levels) {
+	const list = document.getElementById("audio-list");
+	list.replaceChildren();
+
+	for (const level of levels) {
+		const row = el("div", undefined, "audio-source");
+		const name = el("span", level.source, "audio-name");
+		if (level.clipping) {
+			name.appendChild(el("span", "CLIP", "badge err"));
+		} else if (level.silent) {
+			name.appendChild(el("span", "SILENT", "badge warn"));
+		}
+		row.appendChild(name);
+
+		const meters = el("div", undefined, "meters");
+		for (const ch of level.channels) {
+			const meter = el("div", undefined, "meter");
+			meter.title = `RMS ${ch.rmsDb.toFixed(1)} dBFS, peak ${ch.peakDb.toFixed(1)} dBFS`;
+			const rms = el("div", undefined, ch.rmsDb > meterHotDB ? "rms hot" : "rms");
+			rms.style.width = meterWidth(ch.rmsDb) + "%";
+			const peak = el("div", undefined, "peak");
+			peak.style.left = meterWidth(ch.peakDb) + "%";
+			meter.append(rms, peak);
+			meters.appendChild(meter);
+		}
+		row.appendChild(meters);
+
+		const peak = Math.max(...level.channels.map((ch) => ch.peakDb));
+		row.appendChild(el("span", level.channels.length ? peak.toFixed(1) + " dBFS" : "", "num"));
+		list.appendChild(row);
+	}
+}
+
+async function updateAudio() {
+	try {
+		renderAudio(await (await authFetch(audioURL)).json());
+	} catch (err) {
+		document.getElementById("audio-list").textContent = String(err);
+	}
+}
+
+async function updateStatus() {
+	try {
+		const status = await (await authFetch(statusURL)).json();
+
+		renderState(status.pipeline.state);
+		renderOutputs(status.outputs);
+		renderPipeline(status);
+		document.getElementById("updated").textContent = "Updated " + new Date(status.time).toLocaleTimeString();
+	} catch (err) {
+		renderState("UNREACHABLE");
+		document.getElementById("updated").textContent = String(err);
+	}
+}
+
+function updateSnapshots() {
+	for (const img of document.querySelectorAll("img[data-source]")) {
+		loadImage(img, `../snapshot/${img.dataset.source}?width=${snapshotWidth}`);
+	}
+}
+
+updateStatus();
+updateAudio();
+updateSnapshots();
+loadImage(document.getElementById("graph-image"), "../graph?details=states&format=svg");
+setInterval(updateStatus, statusInterval);
+setInterval(updateAudio, statusInterval);
+setInterval(updateSnapshots, snapshotInterval);